@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+
 	"github.com/nettyrnp/ads-crawler/api/sys"
 	"github.com/nettyrnp/ads-crawler/api/sys/entity"
 	"github.com/nettyrnp/ads-crawler/config"
@@ -20,4 +22,8 @@ func (api *API) NewTPPModule(conf config.Config, kind0 entity.TPPKind) {
 	kind := string(kind0)
 	c := sys.NewController(conf, kind)
 	sys.Route(api.Router, c)
+
+	if conf.SchedulerEnabled {
+		go c.Scheduler.Run(context.Background())
+	}
 }
@@ -1,12 +1,15 @@
 package sys
 
 import (
+	"context"
 	"github.com/nettyrnp/ads-crawler/api/sys/notify"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/nettyrnp/ads-crawler/api/common"
+	"github.com/nettyrnp/ads-crawler/api/sys/crawler"
 	"github.com/nettyrnp/ads-crawler/api/sys/http"
 	"github.com/nettyrnp/ads-crawler/api/sys/repository"
 	"github.com/nettyrnp/ads-crawler/api/sys/service"
@@ -30,23 +33,79 @@ func NewRepository(conf config.Config, kind string) *repository.RDBMSRepository
 	return repo
 }
 
-func NewController(conf config.Config, kind string) *http.Controller {
+func NewService(conf config.Config, kind string) *service.AdsService {
 	repo := NewRepository(conf, kind)
 	ns := notify.NewSmsNotifier(conf, kind)
 	emailNotifier := notify.NewEmailNotifier(conf, kind)
 
-	svc := service.New(conf, kind, repo, ns, emailNotifier)
+	return service.New(conf, kind, repo, ns, emailNotifier)
+}
+
+func NewCrawler(conf config.Config, svc service.Service) *crawler.Crawler {
+	client, err := crawler.NewClient(conf)
+	if err != nil {
+		common.LogError(err.Error())
+		os.Exit(1)
+	}
+	sellersClient, err := crawler.NewSellersClient(conf)
+	if err != nil {
+		common.LogError(err.Error())
+		os.Exit(1)
+	}
+	cr := crawler.New(conf, svc, client)
+	cr.SellersFetcher = sellersClient
+	return cr
+}
 
-	return http.New(svc, conf, kind)
+func NewController(conf config.Config, kind string) *http.Controller {
+	svc := NewService(conf, kind)
+
+	failStaleCrawlJobs(svc)
+	if conf.CrawlJobStaleAfter > 0 {
+		go func() {
+			// The jobs of a crashed process, e.g. of the previous run of this one, go stale only after a while
+			for range time.Tick(conf.CrawlJobStaleAfter) {
+				failStaleCrawlJobs(svc)
+			}
+		}()
+	}
+
+	cr := NewCrawler(conf, svc)
+	return http.New(svc, cr, crawler.NewScheduler(conf, cr), conf, kind)
+}
+
+// failStaleCrawlJobs closes the crawl jobs left unfinished by a process which went away, keeping the ones still
+// run by this or another process (e.g. the CLI), as they keep beating
+func failStaleCrawlJobs(svc service.Service) {
+	n, err := svc.FailUnfinishedCrawlJobs(context.Background())
+	if err != nil {
+		common.LogErrorf("failed to close unfinished crawl jobs: %v", err)
+	} else if n > 0 {
+		common.LogInfof("Marked %v interrupted crawl jobs as failed", n)
+	}
 }
 
 func Route(mux *mux.Router, c *http.Controller) {
 	mux.HandleFunc("/crawler/admin/version", c.Version).Methods("GET")
 	mux.HandleFunc("/crawler/admin/logs", c.Logs).Methods("GET")
 	mux.HandleFunc("/crawler/start_poll", c.StartPolling).Methods("POST")
+	mux.HandleFunc("/crawler/jobs/{id}", c.GetCrawlJob).Methods("GET", "OPTIONS")
+	mux.HandleFunc("/crawler/jobs/{id}/cancel", c.CancelCrawlJob).Methods("POST", "OPTIONS")
+	mux.HandleFunc("/crawler/schedule", c.GetSchedule).Methods("GET", "OPTIONS")
+	mux.HandleFunc("/crawler/sellers/start_poll", c.StartSellers).Methods("POST", "OPTIONS")
 
 	mux.HandleFunc("/crawler/portals", c.GetPortals).Methods("GET", "OPTIONS")
 	mux.HandleFunc("/crawler/portals", c.GetPortalsExt).Methods("POST", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/new", c.AddPortal).Methods("POST", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/import", c.ImportPortals).Methods("POST", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/{name}", c.UpdatePortal).Methods("PUT", "PATCH", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/{name}", c.DeletePortal).Methods("DELETE", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/{name}/variables", c.GetPortalVariables).Methods("GET", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/{name}/mismatches", c.GetSellerMismatches).Methods("GET", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/{name}/crawls", c.GetPortalCrawls).Methods("GET", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/{name}/snapshots", c.ListSnapshots).Methods("GET", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/{name}/snapshots/{id}", c.GetSnapshot).Methods("GET", "OPTIONS")
+	mux.HandleFunc("/crawler/portals/{name}/diff", c.GetProviderDiff).Methods("GET", "OPTIONS")
 	mux.HandleFunc("/crawler/providers/portal/{name}", c.GetProvidersByPortal).Methods("GET", "OPTIONS")
 
 	mux.HandleFunc("/crawler/providers/portal/{name}", c.DeleteProvider).Methods("DELETE", "OPTIONS")
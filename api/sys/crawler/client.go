@@ -0,0 +1,153 @@
+package crawler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/config"
+)
+
+// NewClient returns the HTTP client of the crawler. It does not follow redirects, the crawler does so itself
+// in order to enforce the rules of the ads.txt specification. The connect timeout applies to the TCP and TLS
+// handshakes, the read timeout to the rest of a request, including its body.
+// Every request is sent with the User-Agent and the extra headers of the config, through its proxy if any,
+// trusting the certificates of its CA bundle besides the ones of the system.
+func NewClient(conf config.Config) (*http.Client, error) {
+	return newClient(conf, conf.CrawlReadTimeout)
+}
+
+// NewSellersClient returns the HTTP client fetching the sellers.json files, which are much larger than any ads.txt.
+// It is the client of NewClient, with the read timeout of the sellers.json files.
+func NewSellersClient(conf config.Config) (*http.Client, error) {
+	return newClient(conf, conf.SellersReadTimeout)
+}
+
+func newClient(conf config.Config, readTimeout time.Duration) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   conf.CrawlConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   conf.CrawlConnectTimeout,
+		ResponseHeaderTimeout: readTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if conf.CrawlProxy != "" {
+		proxy, err := parseProxy(conf.CrawlProxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if conf.CrawlCABundle != "" {
+		pool, err := loadCABundle(conf.CrawlCABundle)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	header, err := parseHeaders(conf.CrawlHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if conf.CrawlUserAgent != "" {
+		header.Set("User-Agent", conf.CrawlUserAgent)
+	}
+
+	client := &http.Client{
+		Transport: &headerTransport{header: header, base: transport},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	// The deadline of the whole request, the connect timeout only adds to it
+	if readTimeout > 0 {
+		client.Timeout = conf.CrawlConnectTimeout + readTimeout
+	}
+	return client, nil
+}
+
+// headerTransport sets the headers on every request, unless the request has them already
+type headerTransport struct {
+	header http.Header
+	base   http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.header) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request
+	req2 := *req
+	req2.Header = http.Header{}
+	for k, v := range req.Header {
+		req2.Header[k] = v
+	}
+	for k, v := range t.header {
+		if _, ok := req2.Header[k]; !ok {
+			req2.Header[k] = v
+		}
+	}
+	return t.base.RoundTrip(&req2)
+}
+
+// parseProxy parses the URL of an HTTP, HTTPS or SOCKS5 proxy
+func parseProxy(rawURL string) (*url.URL, error) {
+	proxy, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid crawler proxy '%v'", rawURL)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, errors.Errorf("unsupported scheme of crawler proxy '%v'", rawURL)
+	}
+	if proxy.Host == "" {
+		return nil, errors.Errorf("crawler proxy '%v' has no host", rawURL)
+	}
+	return proxy, nil
+}
+
+// loadCABundle returns the certificates of the system, together with the ones of the PEM file
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading crawler CA bundle")
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in crawler CA bundle '%v'", path)
+	}
+	return pool, nil
+}
+
+// parseHeaders parses the extra headers of the crawler, given as 'Name: value'
+func parseHeaders(lines []string) (http.Header, error) {
+	header := http.Header{}
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, errors.Errorf("invalid crawler header '%v', expecting 'Name: value'", line)
+		}
+		header.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	return header, nil
+}
@@ -0,0 +1,478 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/api/common"
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+	"github.com/nettyrnp/ads-crawler/config"
+)
+
+// Fetcher performs the HTTP requests of the crawler. *http.Client satisfies it, but should not follow
+// redirects itself (see NewClient), so that the crawler can enforce the redirect rules of the ads.txt specification.
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type store interface {
+	GetPortals(ctx context.Context) ([]*entity.Portal, error)
+	ReplaceProvidersAndVariables(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider, vars []*entity.Variable) (int, error)
+	NotifyPortalAdmins(ctx context.Context, portal *entity.Portal) error
+	AddCrawlJob(ctx context.Context, portals []*entity.Portal) (*entity.CrawlJob, error)
+	UpdateCrawlJob(ctx context.Context, job *entity.CrawlJob) error
+	UpdateCrawlResult(ctx context.Context, res *entity.CrawlResult) error
+	TouchCrawlJob(ctx context.Context, id int) error
+	GetDuePortals(ctx context.Context, till time.Time) ([]*entity.Portal, error)
+	SetNextCrawls(ctx context.Context, next map[int]time.Time) error
+	SetPortalProtocol(ctx context.Context, portalID int, protocol string, fallbacks int) error
+	GetPortalFile(ctx context.Context, portalID int, kind entity.FileKind) (*entity.PortalFile, error)
+	SavePortalFile(ctx context.Context, file *entity.PortalFile) error
+	GetPortalVariables(ctx context.Context, portalName string) ([]*entity.Variable, error)
+	AddSnapshot(ctx context.Context, snap *entity.Snapshot) (bool, error)
+	PruneSnapshots(ctx context.Context, before time.Time) (int, error)
+	AddSubdomainPortals(ctx context.Context, parent *entity.Portal, names []string) ([]*entity.Portal, error)
+	AddCrawlResults(ctx context.Context, job *entity.CrawlJob, portals []*entity.Portal) error
+	GetProviderDomains(ctx context.Context) ([]string, error)
+	ReplaceSellers(ctx context.Context, adSystem string, sellers []*entity.Seller) (int, error)
+}
+
+// Result is the outcome of crawling a single portal
+type Result struct {
+	Portal       *entity.Portal
+	Providers    int
+	Errors       []error             // errors of single lines, which do not fail the portal
+	Diagnostics  []entity.Diagnostic // all problems found in the ads.txt, including warnings
+	Variables    []*entity.Variable
+	Missing      []entity.FileKind // files of the portal which are not published
+	Unchanged    []entity.FileKind // files of the portal which did not change since the last crawl
+	Fetches      entity.Fetches    // where the files were fetched from
+	Fallbacks    int               // files fetched over the other protocol than the one of the portal
+	StatusCode   int               // of the last file fetched
+	Bytes        int64
+	SoftNotFound []string // files served with 2xx, but taken as missing, with the reason
+	NotFound     bool     // none of the files is published
+	Duration     time.Duration
+}
+
+// Message summarizes the result for the crawl job records
+func (r Result) Message() string {
+	if r.NotFound {
+		msg := fileNames(r.Missing) + " not found"
+		if len(r.SoftNotFound) > 0 {
+			msg += " (soft 404: " + strings.Join(r.SoftNotFound, "; ") + ")"
+		}
+		return msg
+	}
+	var msg string
+	if len(r.Errors) > 0 {
+		msg = common.JoinErrors(r.Errors).Error()
+	}
+	if warnings := len(r.Diagnostics) - len(r.Errors); warnings > 0 {
+		msg = strings.TrimSpace(fmt.Sprintf("%v (%v warnings)", msg, warnings))
+	}
+	if len(r.Unchanged) > 0 {
+		msg = strings.TrimSpace(fileNames(r.Unchanged) + " unchanged " + msg)
+	}
+	return msg
+}
+
+// AllUnchanged reports whether none of the files fetched for the portal changed since the last crawl
+func (r Result) AllUnchanged() bool {
+	return len(r.Unchanged) > 0 && len(r.Unchanged) == len(r.Fetches)
+}
+
+func fileNames(kinds []entity.FileKind) string {
+	var files []string
+	for _, kind := range kinds {
+		files = append(files, string(kind))
+	}
+	return strings.Join(files, ", ")
+}
+
+// Progress is notified about every portal processed by CrawlPortals, i being the index of the portal
+type Progress interface {
+	Started(i int)
+	Finished(i int, res Result, err error)
+}
+
+type Crawler struct {
+	Conf           config.Config
+	Store          store
+	Fetcher        Fetcher
+	SellersFetcher Fetcher // fetches the sellers.json files, Fetcher does so if it is nil
+	Force          bool    // re-fetches and stores every file, ignoring the state of its last fetch
+
+	limiter *hostLimiter
+	jobsMu  sync.Mutex
+	jobs    map[int]context.CancelFunc
+	busy    map[int]int // number of unfinished jobs per portal ID
+
+	sellersRunning int32 // set while the sellers.json files are crawled
+}
+
+func New(conf config.Config, s store, f Fetcher) *Crawler {
+	return &Crawler{
+		Conf:    conf,
+		Store:   s,
+		Fetcher: f,
+		limiter: newHostLimiter(conf.CrawlHostConcurrency, conf.CrawlHostDelay),
+		jobs:    map[int]context.CancelFunc{},
+		busy:    map[int]int{},
+	}
+}
+
+// CrawlAll crawls every portal known to the store. The failures of single portals are logged only.
+func (c *Crawler) CrawlAll(ctx context.Context) ([]Result, error) {
+	portals, err := c.Store.GetPortals(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find any portals in storage")
+	}
+	results := make([]Result, len(portals))
+	err = c.CrawlPortals(ctx, portals, collector(results))
+	return results, err
+}
+
+// CrawlPortals crawls the portals with a pool of workers. A failed portal does not stop the others,
+// its error is reported to progress. The crawl stops once ctx is cancelled, returning ctx.Err().
+func (c *Crawler) CrawlPortals(ctx context.Context, portals []*entity.Portal, progress Progress) error {
+	work := make(chan int)
+	var wg sync.WaitGroup
+	workers := c.Conf.CrawlConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(portals) {
+		workers = len(portals)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if ctx.Err() != nil {
+					continue
+				}
+				if progress != nil {
+					progress.Started(i)
+				}
+				res, err := c.CrawlPortal(ctx, portals[i])
+				if err != nil && ctx.Err() == nil {
+					common.LogErrorf("Failed to crawl portal '%v': %v", portals[i].CanonicalName, err)
+				}
+				if progress != nil {
+					progress.Finished(i, res, err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range portals {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// CrawlPortal fetches the ads.txt and/or app-ads.txt of a single portal and replaces its stored providers.
+// The stored providers are kept if a file could not be fetched.
+func (c *Crawler) CrawlPortal(ctx context.Context, portal *entity.Portal) (Result, error) {
+	start := time.Now()
+	res := Result{Portal: portal}
+	err := c.crawlPortal(ctx, portal, &res)
+	res.Duration = time.Now().Sub(start)
+	return res, err
+}
+
+func (c *Crawler) crawlPortal(ctx context.Context, portal *entity.Portal, res *Result) error {
+	files := portal.FileKind.Files()
+	for _, kind := range files {
+		if err := c.crawlFile(ctx, portal, kind, res); err != nil {
+			return err
+		}
+	}
+
+	// A portal is missing its files only if none of them is published
+	if len(res.Missing) == len(files) {
+		res.NotFound = true
+		c.Store.NotifyPortalAdmins(ctx, portal)
+	}
+	return c.updateProtocol(ctx, portal, res)
+}
+
+// crawlFile fetches a single file of the portal, replacing the providers and variables stored for the file.
+// A file which did not change since its last fetch is not parsed again.
+func (c *Crawler) crawlFile(ctx context.Context, portal *entity.Portal, kind entity.FileKind, res *Result) error {
+	var last *entity.PortalFile
+	var err error
+	header := http.Header{}
+	if !c.Force {
+		last, err = c.lastFetch(ctx, portal, kind)
+		if err != nil {
+			return err
+		}
+		if last != nil {
+			if last.ETag != "" {
+				header.Set("If-None-Match", last.ETag)
+			}
+			if last.LastModified != "" {
+				header.Set("If-Modified-Since", last.LastModified)
+			}
+		}
+	}
+
+	resp, chain, fellBack, err := c.fetch(ctx, portal, kind, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if fellBack {
+		res.Fallbacks++
+	}
+	url := chain[len(chain)-1]
+	res.Fetches = append(res.Fetches, entity.FileFetch{File: kind, URL: url, Redirects: chain[:len(chain)-1], StatusCode: resp.StatusCode})
+	res.StatusCode = resp.StatusCode
+	if resp.StatusCode == http.StatusNotModified && last != nil {
+		last.FetchedAt = time.Now().UTC()
+		return c.unchanged(ctx, portal, kind, last, res)
+	}
+	body, err := c.readBody(resp)
+	res.Fetches[len(res.Fetches)-1].Bytes = int64(len(body))
+	res.Bytes += int64(len(body))
+	if err != nil {
+		return err
+	}
+	file := &entity.PortalFile{PortalID: portal.ID, FileKind: kind, FetchedAt: time.Now().UTC()}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if reason := htmlPage(body); reason != "" {
+			return c.missing(ctx, portal, kind, res, reason)
+		}
+		if ct := resp.Header.Get("Content-Type"); !isPlainText(ct) {
+			if c.Conf.CrawlRejectNonText {
+				return errors.Wrapf(ErrNotText, "%v of portal '%v' is served as '%v'", kind, portal.CanonicalName, ct)
+			}
+			res.Diagnostics = append(res.Diagnostics, entity.Diagnostic{
+				File:     kind,
+				Severity: entity.SeverityWarning,
+				Message:  fmt.Sprintf("served as '%v' instead of text/plain", ct),
+			})
+		}
+		// The stored providers are kept, as an empty file is rather a failure of the server
+		if len(bytes.TrimSpace(body)) == 0 {
+			return ErrEmptyFile
+		}
+		sum := sha256.Sum256(body)
+		file.ETag = resp.Header.Get("ETag")
+		file.LastModified = resp.Header.Get("Last-Modified")
+		file.SHA256 = hex.EncodeToString(sum[:])
+		if last != nil && last.SHA256 == file.SHA256 {
+			file.Providers = last.Providers
+			return c.unchanged(ctx, portal, kind, file, res)
+		}
+
+		adsTxt := entity.ParseAdsTxt(body)
+		if reason := softNotFound(resp.Header.Get("Content-Type"), adsTxt, c.Conf.CrawlSoftNotFoundRatio); reason != "" {
+			return c.missing(ctx, portal, kind, res, reason)
+		}
+		now := time.Now().UTC()
+		providers := adsTxt.Providers
+		for _, provider := range providers {
+			provider.PortalID = portal.ID
+			provider.FileKind = kind
+			provider.CreatedAt = now
+		}
+		for _, v := range adsTxt.Variables {
+			v.FileKind = kind
+		}
+		for i := range adsTxt.Diagnostics {
+			d := &adsTxt.Diagnostics[i]
+			d.File = kind
+			res.Diagnostics = append(res.Diagnostics, *d)
+			if d.Severity == entity.SeverityError {
+				res.Errors = append(res.Errors, *d)
+			}
+		}
+
+		// Replace the stored providers and variables at once
+		n, err := c.Store.ReplaceProvidersAndVariables(ctx, portal.ID, kind, providers, adsTxt.Variables)
+		if err != nil {
+			return err
+		}
+		res.Providers += n
+		res.Variables = append(res.Variables, adsTxt.Variables...)
+		file.Providers = n
+		// The hash is stored after the snapshot, so that a file whose snapshot failed is parsed anew by the next crawl
+		snap := &entity.Snapshot{
+			PortalID:    portal.ID,
+			FileKind:    kind,
+			FetchedAt:   file.FetchedAt,
+			SHA256:      file.SHA256,
+			Providers:   n,
+			Content:     string(body),
+			Diagnostics: adsTxt.Diagnostics,
+		}
+		if _, err := c.Store.AddSnapshot(ctx, snap); err != nil {
+			return err
+		}
+		if err := c.Store.SavePortalFile(ctx, file); err != nil {
+			return err
+		}
+		common.LogInfof("Got %v bytes of %v on portal '%v' [from %v]", len(body), kind, portal.CanonicalName, url)
+		common.LogInfof("Parsed %v providers of %v for portal '%v', stored %v", len(providers), kind, portal.CanonicalName, n)
+		if len(providers) > 0 {
+			var sb bytes.Buffer
+			for _, p := range providers {
+				sb.WriteString(fmt.Sprintf("%v\n", *p))
+			}
+			common.LogInfof("Providers of %v for portal '%v':\n%v", kind, portal.CanonicalName, sb.String())
+		}
+		if len(adsTxt.Diagnostics) > 0 {
+			var sb bytes.Buffer
+			for _, d := range adsTxt.Diagnostics {
+				sb.WriteString(fmt.Sprintf("%v\n", d.Error()))
+			}
+			common.LogErrorf("Diagnostics of %v for portal '%v':\n%v", kind, portal.CanonicalName, sb.String())
+		}
+
+	} else if resp.StatusCode == http.StatusNotFound {
+		return c.missing(ctx, portal, kind, res, "")
+
+	} else {
+		return &StatusError{Code: resp.StatusCode, URL: url}
+	}
+	return nil
+}
+
+// lastFetch returns the state of the last fetch of the file, or nil if the file has to be fetched and parsed anew
+// as it was never fetched successfully. Deleting the providers of a portal forgets the state of its files as well.
+func (c *Crawler) lastFetch(ctx context.Context, portal *entity.Portal, kind entity.FileKind) (*entity.PortalFile, error) {
+	last, err := c.Store.GetPortalFile(ctx, portal.ID, kind)
+	if errors.Cause(err) == entity.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if last.SHA256 == "" {
+		return nil, nil
+	}
+	return last, nil
+}
+
+// missing clears the providers and variables stored for a file which is not published. A reason is given
+// for a file served with 2xx, which turned out not to be an ads.txt (a soft 404); its diagnostics are dropped.
+func (c *Crawler) missing(ctx context.Context, portal *entity.Portal, kind entity.FileKind, res *Result, reason string) error {
+	res.Missing = append(res.Missing, kind)
+	if reason != "" {
+		common.LogInfof("Taking %v of portal '%v' as missing: %v", kind, portal.CanonicalName, reason)
+		res.SoftNotFound = append(res.SoftNotFound, fmt.Sprintf("%v: %v", kind, reason))
+		diagnostics := res.Diagnostics[:0]
+		for _, d := range res.Diagnostics {
+			if d.File != kind {
+				diagnostics = append(diagnostics, d)
+			}
+		}
+		res.Diagnostics = diagnostics
+	}
+
+	if _, err := c.Store.ReplaceProvidersAndVariables(ctx, portal.ID, kind, nil, nil); err != nil {
+		return err
+	}
+	return c.Store.SavePortalFile(ctx, &entity.PortalFile{PortalID: portal.ID, FileKind: kind, FetchedAt: time.Now().UTC()})
+}
+
+// readBody reads the body of the response, up to the maximum body size. A larger body is not read
+// any further and fails with ErrTooLarge.
+func (c *Crawler) readBody(resp *http.Response) ([]byte, error) {
+	body, err := limitBody(resp, c.Conf.CrawlMaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(body)
+}
+
+// limitBody returns the body of the response, of which the reads beyond max bytes fail with ErrTooLarge.
+// A max of 0 disables the limit.
+func limitBody(resp *http.Response, max int64) (io.Reader, error) {
+	if max <= 0 {
+		return resp.Body, nil
+	}
+	if resp.ContentLength > max {
+		return nil, errors.Wrapf(ErrTooLarge, "%v bytes exceed the limit of %v", resp.ContentLength, max)
+	}
+	return &maxReader{r: resp.Body, max: max}, nil
+}
+
+// maxReader reads up to max bytes, failing with ErrTooLarge once there are more
+type maxReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (m *maxReader) Read(p []byte) (int, error) {
+	// One byte more than allowed tells a larger body
+	if left := m.max - m.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if m.n > m.max {
+		return n - int(m.n-m.max), errors.Wrapf(ErrTooLarge, "more than %v bytes", m.max)
+	}
+	return n, err
+}
+
+// isPlainText reports whether the content type is text/plain, whatever its parameters
+func isPlainText(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/plain"
+}
+
+// unchanged keeps the providers and variables stored for a file which did not change since its last fetch
+func (c *Crawler) unchanged(ctx context.Context, portal *entity.Portal, kind entity.FileKind, file *entity.PortalFile, res *Result) error {
+	if err := c.Store.SavePortalFile(ctx, file); err != nil {
+		return err
+	}
+	// The variables are reported again, e.g. for following the subdomains
+	vars, err := c.Store.GetPortalVariables(ctx, portal.CanonicalName)
+	if err != nil {
+		return err
+	}
+	for _, v := range vars {
+		if v.FileKind == kind {
+			res.Variables = append(res.Variables, v)
+		}
+	}
+	res.Providers += file.Providers
+	res.Unchanged = append(res.Unchanged, kind)
+	common.LogInfof("%v of portal '%v' is unchanged since %v", kind, portal.CanonicalName, file.FetchedAt.Format(time.RFC3339))
+	return nil
+}
+
+type collector []Result
+
+func (c collector) Started(i int) {}
+
+func (c collector) Finished(i int, res Result, err error) {
+	c[i] = res
+}
@@ -0,0 +1,1201 @@
+package crawler
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+	"github.com/nettyrnp/ads-crawler/config"
+)
+
+type testStore struct {
+	mu         sync.Mutex
+	portals    []*entity.Portal
+	providers  map[int][]*entity.Provider
+	variables  map[int][]*entity.Variable
+	sellers    map[string][]*entity.Seller
+	notified   []string
+	protocols  []string // protocol updates, as protocol:fallbacks
+	files      map[string]*entity.PortalFile
+	snapshots  []*entity.Snapshot
+	snapErr    error // returned by AddSnapshot if set
+	jobs       []*entity.CrawlJob
+	heartbeats int
+}
+
+func newTestStore(portals ...*entity.Portal) *testStore {
+	return &testStore{portals: portals, providers: map[int][]*entity.Provider{}, variables: map[int][]*entity.Variable{}, sellers: map[string][]*entity.Seller{}, files: map[string]*entity.PortalFile{}}
+}
+
+func (s *testStore) GetPortals(ctx context.Context) ([]*entity.Portal, error) {
+	return s.portals, nil
+}
+
+func (s *testStore) ReplaceProvidersAndVariables(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider, vars []*entity.Variable) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.providers[portalID] = providers
+	s.variables[portalID] = vars
+	return len(providers), nil
+}
+
+// deleteProviders mirrors the repository: the state of the last fetches of the portal is forgotten with its providers
+func (s *testStore) deleteProviders(portalID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.providers[portalID] = nil
+	for key, f := range s.files {
+		if f.PortalID == portalID {
+			delete(s.files, key)
+		}
+	}
+}
+
+func (s *testStore) NotifyPortalAdmins(ctx context.Context, portal *entity.Portal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notified = append(s.notified, portal.CanonicalName)
+	return nil
+}
+
+func (s *testStore) AddCrawlJob(ctx context.Context, portals []*entity.Portal) (*entity.CrawlJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := &entity.CrawlJob{ID: len(s.jobs) + 1, State: entity.JobQueued, PortalsTotal: len(portals)}
+	for _, p := range portals {
+		job.Results = append(job.Results, &entity.CrawlResult{JobID: job.ID, PortalID: p.ID, PortalName: p.CanonicalName, State: entity.JobQueued})
+	}
+	s.jobs = append(s.jobs, job)
+	return job, nil
+}
+
+func (s *testStore) UpdateCrawlJob(ctx context.Context, job *entity.CrawlJob) error {
+	return nil
+}
+
+func (s *testStore) UpdateCrawlResult(ctx context.Context, res *entity.CrawlResult) error {
+	return nil
+}
+
+func (s *testStore) TouchCrawlJob(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeats++
+	return nil
+}
+
+func (s *testStore) GetDuePortals(ctx context.Context, till time.Time) ([]*entity.Portal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*entity.Portal
+	for _, p := range s.portals {
+		if p.NextCrawlAt == nil || !p.NextCrawlAt.After(till) {
+			due = append(due, p)
+		}
+	}
+	return due, nil
+}
+
+func (s *testStore) SetNextCrawls(ctx context.Context, next map[int]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.portals {
+		if at, ok := next[p.ID]; ok {
+			p.NextCrawlAt = &at
+		}
+	}
+	return nil
+}
+
+func (s *testStore) SetPortalProtocol(ctx context.Context, portalID int, protocol string, fallbacks int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.protocols = append(s.protocols, fmt.Sprintf("%v:%v", protocol, fallbacks))
+	return nil
+}
+
+func (s *testStore) GetPortalFile(ctx context.Context, portalID int, kind entity.FileKind) (*entity.PortalFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[fmt.Sprintf("%v/%v", portalID, kind)]
+	if !ok {
+		return nil, entity.ErrNotFound
+	}
+	copied := *f
+	return &copied, nil
+}
+
+func (s *testStore) SavePortalFile(ctx context.Context, file *entity.PortalFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *file
+	s.files[fmt.Sprintf("%v/%v", file.PortalID, file.FileKind)] = &copied
+	return nil
+}
+
+func (s *testStore) GetPortalVariables(ctx context.Context, portalName string) ([]*entity.Variable, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.portals {
+		if p.CanonicalName == portalName {
+			return s.variables[p.ID], nil
+		}
+	}
+	return nil, entity.ErrNotFound
+}
+
+func (s *testStore) AddSnapshot(ctx context.Context, snap *entity.Snapshot) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapErr != nil {
+		return false, s.snapErr
+	}
+	for i := len(s.snapshots) - 1; i >= 0; i-- {
+		last := s.snapshots[i]
+		if last.PortalID == snap.PortalID && last.FileKind == snap.FileKind {
+			if last.SHA256 == snap.SHA256 {
+				return false, nil
+			}
+			break
+		}
+	}
+	snap.ID = len(s.snapshots) + 1
+	s.snapshots = append(s.snapshots, snap)
+	return true, nil
+}
+
+func (s *testStore) PruneSnapshots(ctx context.Context, before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (s *testStore) AddSubdomainPortals(ctx context.Context, parent *entity.Portal, names []string) ([]*entity.Portal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var children []*entity.Portal
+	for _, name := range names {
+		child := &entity.Portal{ID: len(s.portals) + 1, Protocol: parent.Protocol, CanonicalName: name, ParentID: parent.ID}
+		s.portals = append(s.portals, child)
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+func (s *testStore) AddCrawlResults(ctx context.Context, job *entity.CrawlJob, portals []*entity.Portal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range portals {
+		job.Results = append(job.Results, &entity.CrawlResult{JobID: job.ID, PortalID: p.ID, PortalName: p.CanonicalName, State: entity.JobQueued})
+	}
+	job.PortalsTotal += len(portals)
+	return nil
+}
+
+func (s *testStore) GetProviderDomains(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var domains []string
+	seen := map[string]bool{}
+	for _, providers := range s.providers {
+		for _, p := range providers {
+			if !seen[p.DomainName] {
+				seen[p.DomainName] = true
+				domains = append(domains, p.DomainName)
+			}
+		}
+	}
+	sort.Strings(domains)
+	return domains, nil
+}
+
+func (s *testStore) ReplaceSellers(ctx context.Context, adSystem string, sellers []*entity.Seller) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sellers[adSystem] = sellers
+	return len(sellers), nil
+}
+
+// hostFetcher sends the requests for any host to the test server, keeping the requested host
+type hostFetcher struct {
+	srv *httptest.Server
+}
+
+func (f hostFetcher) Do(req *http.Request) (*http.Response, error) {
+	req.Host = req.URL.Host
+	req.URL.Host = f.srv.Listener.Addr().String()
+	client := *f.srv.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client.Do(req)
+}
+
+func newTestServer(files map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, body)
+	}))
+}
+
+func testPortal(id int, srv *httptest.Server) *entity.Portal {
+	return &entity.Portal{
+		ID:            id,
+		Protocol:      "http",
+		CanonicalName: strings.TrimPrefix(srv.URL, "http://"),
+	}
+}
+
+func TestCrawlPortal(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(map[string]string{
+		"/ads.txt": "# ads.txt\ngoogle.com, pub-1, DIRECT, f08c47fec0942fa0\nappnexus.com, 42, RESELLER\ninvalid line\nOWNERDOMAIN=example.com\n",
+	})
+	defer srv.Close()
+
+	portal := testPortal(1, srv)
+	s := newTestStore(portal)
+	c := New(config.Config{}, s, srv.Client())
+
+	res, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Providers)
+	assert.False(t, res.NotFound)
+	require.Len(t, s.providers[1], 2)
+	assert.Equal(t, "google.com", s.providers[1][0].DomainName)
+	assert.Equal(t, "appnexus.com", s.providers[1][1].DomainName)
+	require.Len(t, res.Errors, 1)
+	assert.Equal(t, 4, res.Diagnostics[0].Line)
+	assert.Equal(t, entity.SeverityError, res.Diagnostics[0].Severity)
+	require.Len(t, s.variables[1], 1)
+	assert.Equal(t, entity.VarOwnerDomain, s.variables[1][0].Name)
+	assert.Equal(t, "example.com", s.variables[1][0].Value)
+}
+
+func TestCrawlPortalNotFound(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(map[string]string{})
+	defer srv.Close()
+
+	portal := testPortal(1, srv)
+	s := newTestStore(portal)
+	c := New(config.Config{}, s, srv.Client())
+
+	res, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.True(t, res.NotFound)
+	assert.Equal(t, []string{portal.CanonicalName}, s.notified)
+}
+
+func TestCrawlPortalSafeguards(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("google.com, pub-1, DIRECT\n"))
+	}))
+	defer srv.Close()
+
+	portal := testPortal(1, srv)
+
+	t.Run("warning", func(t *testing.T) {
+		c := New(config.Config{}, newTestStore(portal), srv.Client())
+		res, err := c.CrawlPortal(context.Background(), portal)
+		require.NoError(t, err)
+		require.NotEmpty(t, res.Diagnostics)
+		assert.Equal(t, entity.SeverityWarning, res.Diagnostics[0].Severity)
+		assert.Contains(t, res.Diagnostics[0].Message, "text/html")
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		c := New(config.Config{CrawlRejectNonText: true}, newTestStore(portal), srv.Client())
+		_, err := c.CrawlPortal(context.Background(), portal)
+		require.Error(t, err)
+		assert.Equal(t, entity.ErrorNotText, Classify(err))
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		big := newTestServer(map[string]string{"/ads.txt": strings.Repeat("google.com, pub-1, DIRECT\n", 100)})
+		defer big.Close()
+
+		portal := testPortal(1, big)
+		c := New(config.Config{CrawlMaxBodySize: 100}, newTestStore(portal), big.Client())
+		res, err := c.CrawlPortal(context.Background(), portal)
+		require.Error(t, err)
+		assert.Equal(t, entity.ErrorTooLarge, Classify(err))
+		assert.True(t, res.Bytes <= 100)
+	})
+}
+
+func TestCrawlPortalReadTimeout(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("google.com, pub-1, DIRECT\n"))
+	}))
+	defer srv.Close()
+
+	portal := testPortal(1, srv)
+	client, err := NewClient(config.Config{CrawlConnectTimeout: time.Second, CrawlReadTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	c := New(config.Config{}, newTestStore(portal), client)
+
+	_, err = c.CrawlPortal(context.Background(), portal)
+	require.Error(t, err)
+	assert.Equal(t, entity.ErrorTimeout, Classify(err))
+}
+
+func TestCrawlPortalSoftNotFound(t *testing.T) {
+	t.Parallel()
+
+	tcases := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"homepage", "text/html; charset=utf-8", "<!DOCTYPE html>\n<html><head><title>Home</title></head><body>Welcome</body></html>\n"},
+		{"markup after blank lines", "text/plain", "\n  \n<HTML>\n<body>Not found</body>\n</HTML>\n"},
+		{"html without markers", "text/html", "Page not found\nSorry, we could not find it\n"},
+		{"invalid lines", "text/plain", "Page not found\nSorry, we could not find it\nGo back home\ngoogle.com, pub-1, DIRECT\n"},
+	}
+	for _, tc := range tcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			portal := testPortal(1, srv)
+			s := newTestStore(portal)
+			c := New(config.Config{CrawlSoftNotFoundRatio: 0.7}, s, srv.Client())
+
+			res, err := c.CrawlPortal(context.Background(), portal)
+			require.NoError(t, err)
+			assert.True(t, res.NotFound)
+			require.Len(t, res.SoftNotFound, 1)
+			assert.Contains(t, res.Message(), "soft 404")
+			assert.Empty(t, res.Diagnostics)
+			assert.Equal(t, []string{portal.CanonicalName}, s.notified)
+		})
+	}
+}
+
+func TestCrawlPortalHTMLInComments(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(map[string]string{
+		"/ads.txt": "# ads.txt of example.com, not an <html> page\n# <!DOCTYPE html> pages are taken as missing\ngoogle.com, pub-1, DIRECT\n",
+	})
+	defer srv.Close()
+
+	portal := testPortal(1, srv)
+	s := newTestStore(portal)
+	c := New(config.Config{CrawlSoftNotFoundRatio: 0.8}, s, srv.Client())
+
+	res, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.False(t, res.NotFound)
+	assert.Empty(t, res.SoftNotFound)
+	assert.Equal(t, 1, res.Providers)
+	assert.Empty(t, s.notified)
+}
+
+func TestCrawlPortalFileKinds(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(map[string]string{
+		"/app-ads.txt": "google.com, pub-1, DIRECT\nappnexus.com, 42, RESELLER\n",
+	})
+	defer srv.Close()
+
+	both := testPortal(1, srv)
+	both.FileKind = entity.FileKindBoth
+	apps := testPortal(2, srv)
+	apps.FileKind = entity.FileKindAppAds
+	s := newTestStore(both, apps)
+	c := New(config.Config{}, s, srv.Client())
+
+	// The missing ads.txt does not count as a missing portal while app-ads.txt is published
+	res, err := c.CrawlPortal(context.Background(), both)
+	require.NoError(t, err)
+	assert.False(t, res.NotFound)
+	assert.Equal(t, []entity.FileKind{entity.FileKindAds}, res.Missing)
+	assert.Equal(t, 2, res.Providers)
+	require.Len(t, s.providers[1], 2)
+	assert.Equal(t, entity.FileKindAppAds, s.providers[1][0].FileKind)
+	assert.Empty(t, s.notified)
+
+	res, err = c.CrawlPortal(context.Background(), apps)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Providers)
+	assert.Empty(t, res.Missing)
+}
+
+func TestRunJob(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(map[string]string{
+		"/ads.txt": "google.com, pub-1, DIRECT\n",
+	})
+	defer srv.Close()
+
+	portals := []*entity.Portal{testPortal(1, srv), testPortal(2, srv), testPortal(3, srv)}
+	s := newTestStore(portals...)
+	c := New(config.Config{CrawlConcurrency: 2, CrawlHostConcurrency: 2}, s, srv.Client())
+
+	job, err := s.AddCrawlJob(context.Background(), portals)
+	require.NoError(t, err)
+	c.RunJob(context.Background(), job, portals)
+
+	assert.Equal(t, entity.JobDone, job.State)
+	assert.Equal(t, 3, job.PortalsDone)
+	assert.Equal(t, 3, job.Providers)
+	for _, res := range job.Results {
+		assert.Equal(t, entity.JobDone, res.State)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, int64(len("google.com, pub-1, DIRECT\n")), res.Bytes)
+		assert.Empty(t, res.ErrorClass)
+	}
+}
+
+func TestRunJobHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("google.com, pub-1, DIRECT\n"))
+	}))
+	defer srv.Close()
+
+	portals := []*entity.Portal{testPortal(1, srv)}
+	s := newTestStore(portals...)
+	c := New(config.Config{CrawlJobHeartbeat: 10 * time.Millisecond}, s, srv.Client())
+
+	job, err := s.AddCrawlJob(context.Background(), portals)
+	require.NoError(t, err)
+	c.RunJob(context.Background(), job, portals)
+	assert.Equal(t, entity.JobDone, job.State)
+
+	// The heartbeat stops with the job
+	s.mu.Lock()
+	beats := s.heartbeats
+	s.mu.Unlock()
+	assert.True(t, beats > 0)
+	time.Sleep(50 * time.Millisecond)
+	s.mu.Lock()
+	assert.Equal(t, beats, s.heartbeats)
+	s.mu.Unlock()
+}
+
+func TestRunJobFailure(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	portals := []*entity.Portal{testPortal(1, srv)}
+	s := newTestStore(portals...)
+	c := New(config.Config{}, s, srv.Client())
+
+	job, err := s.AddCrawlJob(context.Background(), portals)
+	require.NoError(t, err)
+	c.RunJob(context.Background(), job, portals)
+
+	res := job.Results[0]
+	assert.Equal(t, entity.JobFailed, res.State)
+	assert.Equal(t, entity.OutcomeError, res.Outcome)
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+	assert.Equal(t, entity.ErrorHTTP5xx, res.ErrorClass)
+	assert.NotZero(t, res.Bytes)
+
+	assert.Equal(t, entity.JobDone, job.State)
+	assert.Equal(t, 1, job.Failed)
+	assert.Equal(t, "1 of 1 portals failed", job.Message)
+}
+
+func TestRunJobIsolatesFailures(t *testing.T) {
+	t.Parallel()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	srv := newTestServer(map[string]string{"/ads.txt": "google.com, pub-1, DIRECT\n"})
+	defer srv.Close()
+
+	portals := []*entity.Portal{testPortal(1, failing), testPortal(2, srv)}
+	s := newTestStore(portals...)
+	c := New(config.Config{CrawlConcurrency: 1}, s, http.DefaultClient)
+
+	job, err := s.AddCrawlJob(context.Background(), portals)
+	require.NoError(t, err)
+	c.RunJob(context.Background(), job, portals)
+
+	assert.Equal(t, entity.JobDone, job.State)
+	assert.Equal(t, 2, job.PortalsDone)
+	assert.Equal(t, 1, job.Failed)
+	assert.Equal(t, entity.OutcomeError, job.Results[0].Outcome)
+	assert.Equal(t, entity.OutcomeOK, job.Results[1].Outcome)
+	assert.Equal(t, 1, job.Results[1].Providers)
+}
+
+func TestClassify(t *testing.T) {
+	t.Parallel()
+
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com/ads.txt", Err: err}
+	}
+	tcases := []struct {
+		err      error
+		expected entity.ErrorClass
+	}{
+		{urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}}), entity.ErrorDNS},
+		{urlErr(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}), entity.ErrorDNS},
+		{urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), entity.ErrorTCP},
+		{urlErr(errors.New("tls: first record does not look like a TLS handshake")), entity.ErrorTLS},
+		{urlErr(context.DeadlineExceeded), entity.ErrorTimeout},
+		{&StatusError{Code: http.StatusForbidden}, entity.ErrorHTTP4xx},
+		{errors.Wrap(&StatusError{Code: http.StatusServiceUnavailable}, "crawling"), entity.ErrorHTTP5xx},
+		{ErrEmptyFile, entity.ErrorEmptyFile},
+		{errors.Wrap(ErrNotText, "text/html"), entity.ErrorNotText},
+		{errors.Wrap(ErrTooLarge, "too many bytes"), entity.ErrorTooLarge},
+		{errors.Wrap(ErrRedirectPolicy, "too many"), entity.ErrorRedirect},
+		{errors.New("boom"), entity.ErrorOther},
+	}
+	for _, tc := range tcases {
+		assert.Equal(t, tc.expected, Classify(tc.err), tc.err.Error())
+	}
+}
+
+func TestHostLimiterDelay(t *testing.T) {
+	t.Parallel()
+
+	delay := 50 * time.Millisecond
+	l := newHostLimiter(1, delay)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := l.acquire(ctx, "example.com")
+		require.NoError(t, err)
+		release()
+	}
+	assert.True(t, time.Now().Sub(start) >= 2*delay)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := l.acquire(cancelled, "example.com")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestHostLimiterForgetsHosts(t *testing.T) {
+	t.Parallel()
+
+	hosts := func(l *hostLimiter) int {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.hosts)
+	}
+	ctx := context.Background()
+
+	l := newHostLimiter(2, 0)
+	release1, err := l.acquire(ctx, "a.com")
+	require.NoError(t, err)
+	release2, err := l.acquire(ctx, "a.com")
+	require.NoError(t, err)
+	release3, err := l.acquire(ctx, "b.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2, hosts(l))
+	release1()
+	release3()
+	assert.Equal(t, 1, hosts(l))
+	release2()
+	assert.Equal(t, 0, hosts(l))
+
+	// A host is kept till its delay is over
+	l = newHostLimiter(1, 20*time.Millisecond)
+	release, err := l.acquire(ctx, "a.com")
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, 1, hosts(l))
+	deadline := time.Now().Add(5 * time.Second)
+	for hosts(l) > 0 {
+		require.True(t, time.Now().Before(deadline), "host still tracked")
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCrawlPortalLimitsRedirectHost(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "example.com" {
+			http.Redirect(w, r, "http://cdn.example.com/ads.txt", http.StatusMovedPermanently)
+			return
+		}
+		fmt.Fprint(w, "google.com, pub-1, DIRECT\n")
+	}))
+	defer srv.Close()
+
+	portal := &entity.Portal{ID: 1, Protocol: "http", CanonicalName: "example.com"}
+	s := newTestStore(portal)
+	c := New(config.Config{}, s, hostFetcher{srv: srv})
+
+	// The host the portal redirects to is busy
+	release, err := c.limiter.acquire(context.Background(), "cdn.example.com")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = c.CrawlPortal(ctx, portal)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	release()
+
+	res, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Providers)
+	c.limiter.mu.Lock()
+	assert.Empty(t, c.limiter.hosts)
+	c.limiter.mu.Unlock()
+}
+
+func TestSchedulerDispatch(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(map[string]string{
+		"/ads.txt": "google.com, pub-1, DIRECT\n",
+	})
+	defer srv.Close()
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	portals := []*entity.Portal{testPortal(1, srv), testPortal(2, srv), testPortal(3, srv)}
+	portals[1].NextCrawlAt = &past
+	portals[2].NextCrawlAt = &future
+	portals[2].CrawlInterval = 60
+	s := newTestStore(portals...)
+	c := New(config.Config{}, s, srv.Client())
+	sch := NewScheduler(config.Config{SchedulerInterval: time.Hour}, c)
+
+	entries, err := sch.Upcoming(context.Background())
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Nil(t, entries[0].NextCrawlAt)
+	assert.Equal(t, int64(60), entries[2].Interval)
+
+	job, err := sch.Dispatch(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, job)
+	assert.Equal(t, 2, job.PortalsTotal)
+	assert.True(t, portals[0].NextCrawlAt.After(time.Now()))
+	assert.True(t, portals[1].NextCrawlAt.After(time.Now()))
+
+	// Nothing is due until the rescheduled time
+	job, err = sch.Dispatch(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, job)
+}
+
+func TestRunJobSubdomains(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{
+		"example.com":      "SUBDOMAIN=news.example.com\nSUBDOMAIN=other.org\ngoogle.com, pub-1, DIRECT\n",
+		"news.example.com": "SUBDOMAIN=deep.news.example.com\nappnexus.com, 42, DIRECT\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.Host]
+		if !ok || r.URL.Path != "/ads.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	portal := &entity.Portal{ID: 1, Protocol: "http", CanonicalName: "example.com"}
+	s := newTestStore(portal)
+	c := New(config.Config{}, s, hostFetcher{srv: srv})
+
+	job, err := s.AddCrawlJob(context.Background(), []*entity.Portal{portal})
+	require.NoError(t, err)
+	c.RunJob(context.Background(), job, []*entity.Portal{portal})
+
+	assert.Equal(t, entity.JobDone, job.State)
+	assert.Equal(t, 2, job.PortalsTotal)
+	assert.Equal(t, 2, job.PortalsDone)
+	require.Len(t, job.Results, 2)
+	assert.Equal(t, "news.example.com", job.Results[1].PortalName)
+	assert.Equal(t, entity.JobDone, job.Results[1].State)
+
+	// Only the subdomain declared by the root portal is followed
+	require.Len(t, s.portals, 2)
+	assert.Equal(t, 1, s.portals[1].ParentID)
+	require.Len(t, s.providers[2], 1)
+	assert.Equal(t, "appnexus.com", s.providers[2][0].DomainName)
+	assert.False(t, c.Busy(2))
+}
+
+func TestStartJobSubdomains(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "example.com" {
+			fmt.Fprint(w, "SUBDOMAIN=news.example.com\ngoogle.com, pub-1, DIRECT\n")
+			return
+		}
+		fmt.Fprint(w, "appnexus.com, 42, DIRECT\n")
+	}))
+	defer srv.Close()
+
+	portal := &entity.Portal{ID: 1, Protocol: "http", CanonicalName: "example.com"}
+	s := newTestStore(portal)
+	c := New(config.Config{}, s, hostFetcher{srv: srv})
+
+	// The job grows with the subdomains in the background, while its caller reads it as enqueued
+	job, err := c.StartJob(context.Background(), []*entity.Portal{portal})
+	require.NoError(t, err)
+	running := func() bool {
+		c.jobsMu.Lock()
+		defer c.jobsMu.Unlock()
+		_, ok := c.jobs[job.ID]
+		return ok
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for running() {
+		require.True(t, time.Now().Before(deadline), "job still running")
+		assert.Equal(t, 1, job.PortalsTotal)
+		assert.Len(t, job.Results, 1)
+		time.Sleep(time.Millisecond)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Len(t, s.jobs, 1)
+	assert.Equal(t, 2, s.jobs[0].PortalsTotal)
+}
+
+func TestCrawlSellers(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "google.com":
+			fmt.Fprint(w, `{"sellers": [{"seller_id": "pub-1", "seller_type": "publisher", "name": "Example"}, {"seller_id": 42, "seller_type": "INTERMEDIARY", "is_confidential": 1}]}`)
+		case "broken.com":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s := newTestStore()
+	s.providers[1] = []*entity.Provider{
+		{DomainName: "google.com", AccountID: "pub-1", AccountType: entity.RelationshipDirect},
+		{DomainName: "appnexus.com", AccountID: "42", AccountType: entity.RelationshipReseller},
+		{DomainName: "broken.com", AccountID: "7", AccountType: entity.RelationshipDirect},
+	}
+	s.sellers["appnexus.com"] = []*entity.Seller{{AdSystem: "appnexus.com", SellerID: "42"}}
+	c := New(config.Config{}, s, hostFetcher{srv: srv})
+
+	results, err := c.CrawlSellers(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	// The results follow the order of the domains
+	assert.Equal(t, "appnexus.com", results[0].AdSystem)
+	assert.True(t, results[0].NotFound)
+	assert.Empty(t, s.sellers["appnexus.com"])
+
+	assert.Equal(t, "broken.com", results[1].AdSystem)
+	assert.NotEmpty(t, results[1].Error)
+
+	assert.Equal(t, "google.com", results[2].AdSystem)
+	assert.Equal(t, 2, results[2].Sellers)
+	require.Len(t, s.sellers["google.com"], 2)
+	assert.Equal(t, entity.SellerPublisher, s.sellers["google.com"][0].SellerType)
+	assert.Equal(t, "42", s.sellers["google.com"][1].SellerID)
+	assert.True(t, s.sellers["google.com"][1].IsConfidential)
+}
+
+func TestCrawlPortalRedirects(t *testing.T) {
+	t.Parallel()
+
+	redirects := map[string]string{
+		"example.com":     "http://www.example.com/ads.txt",
+		"www.example.com": "http://cdn.example.com/ads.txt",
+		"cdn.example.com": "http://adstxt.host.com/example.txt",
+		"loop.com":        "http://ads.host.com/ads.txt",
+		"ads.host.com":    "http://other.com/ads.txt",
+		"relative.com":    "/other/ads.txt",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if to := redirects[r.Host]; to != "" && r.URL.Path == "/ads.txt" {
+			http.Redirect(w, r, to, http.StatusMovedPermanently)
+			return
+		}
+		fmt.Fprint(w, "google.com, pub-1, DIRECT\n")
+	}))
+	defer srv.Close()
+
+	c := New(config.Config{}, newTestStore(), hostFetcher{srv: srv})
+
+	// Any number of redirects within the root domain, then a single one outside of it
+	res, err := c.CrawlPortal(context.Background(), &entity.Portal{ID: 1, Protocol: "http", CanonicalName: "example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Providers)
+	require.Len(t, res.Fetches, 1)
+	assert.Equal(t, "http://adstxt.host.com/example.txt", res.Fetches[0].URL)
+	assert.Equal(t, []string{"http://example.com/ads.txt", "http://www.example.com/ads.txt", "http://cdn.example.com/ads.txt"}, res.Fetches[0].Redirects)
+
+	res, err = c.CrawlPortal(context.Background(), &entity.Portal{ID: 2, Protocol: "http", CanonicalName: "relative.com"})
+	require.NoError(t, err)
+	require.Len(t, res.Fetches, 1)
+	assert.Equal(t, "http://relative.com/other/ads.txt", res.Fetches[0].URL)
+
+	// The third party location must not redirect any further
+	_, err = c.CrawlPortal(context.Background(), &entity.Portal{ID: 3, Protocol: "http", CanonicalName: "loop.com"})
+	require.Error(t, err)
+	assert.Equal(t, ErrRedirectPolicy, errors.Cause(err))
+}
+
+func TestCrawlPortalProtocolFallback(t *testing.T) {
+	t.Parallel()
+
+	// A plain HTTP server fails the TLS handshake of https requests
+	srv := newTestServer(map[string]string{
+		"/ads.txt": "google.com, pub-1, DIRECT\n",
+	})
+	defer srv.Close()
+
+	portal := &entity.Portal{ID: 1, Protocol: "https", CanonicalName: "example.com"}
+	s := newTestStore(portal)
+	c := New(config.Config{CrawlProtocolSwitch: 2}, s, hostFetcher{srv: srv})
+
+	res, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Providers)
+	assert.Equal(t, 1, res.Fallbacks)
+	assert.Equal(t, "http://example.com/ads.txt", res.Fetches[0].URL)
+	assert.Equal(t, "https", portal.Protocol)
+	assert.Equal(t, 1, portal.Fallbacks)
+
+	// The portal is switched once the fallback worked for consecutive crawls
+	_, err = c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Equal(t, "http", portal.Protocol)
+	assert.Equal(t, 0, portal.Fallbacks)
+
+	res, err = c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Fallbacks)
+	assert.Equal(t, []string{"https:1", "http:0"}, s.protocols)
+}
+
+func TestCrawlPortalUnchanged(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	body, etag := "OWNERDOMAIN=example.com\ngoogle.com, pub-1, DIRECT\n", `"v1"`
+	var conditional []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		if etag != "" {
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	portal := testPortal(1, srv)
+	s := newTestStore(portal)
+	c := New(config.Config{}, s, hostFetcher{srv: srv})
+
+	res, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Empty(t, res.Unchanged)
+	assert.Equal(t, 1, res.Providers)
+
+	// The server answers 304 to the conditional request
+	res, err = c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.True(t, res.AllUnchanged())
+	assert.Equal(t, 1, res.Providers)
+	assert.Len(t, res.Variables, 1)
+	assert.Equal(t, "ads.txt unchanged", res.Message())
+
+	// The same body without validators is recognized by its hash
+	mu.Lock()
+	etag = ""
+	mu.Unlock()
+	res, err = c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.True(t, res.AllUnchanged())
+	assert.Equal(t, 1, res.Providers)
+
+	mu.Lock()
+	body = "google.com, pub-1, DIRECT\nappnexus.com, 42, RESELLER\n"
+	mu.Unlock()
+	res, err = c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Empty(t, res.Unchanged)
+	assert.Equal(t, 2, res.Providers)
+	assert.Len(t, s.providers[portal.ID], 2)
+
+	// Forced crawls ignore the state of the last fetch
+	c.Force = true
+	res, err = c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Empty(t, res.Unchanged)
+
+	// Every distinct body is kept as a snapshot
+	require.Len(t, s.snapshots, 2)
+	assert.Equal(t, "OWNERDOMAIN=example.com\ngoogle.com, pub-1, DIRECT\n", s.snapshots[0].Content)
+	assert.Equal(t, 2, s.snapshots[1].Providers)
+	assert.NotEqual(t, s.snapshots[0].SHA256, s.snapshots[1].SHA256)
+	assert.Equal(t, []string{"", `"v1"`, `"v1"`, "", ""}, conditional)
+}
+
+func TestCrawlPortalSlowBody(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The headers arrive at once, the body trickles in
+		w.Write([]byte("google.com, pub-1, DIRECT\n"))
+		w.(http.Flusher).Flush()
+		for i := 0; i < 20; i++ {
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte("# still sending\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	portal := testPortal(1, srv)
+	client, err := NewClient(config.Config{CrawlReadTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	c := New(config.Config{}, newTestStore(portal), client)
+
+	_, err = c.CrawlPortal(context.Background(), portal)
+	require.Error(t, err)
+	assert.Equal(t, entity.ErrorTimeout, Classify(err))
+}
+
+func TestNewClient(t *testing.T) {
+	t.Parallel()
+
+	var got http.Header
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Write([]byte("google.com, pub-1, DIRECT\n"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "crawler")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(bundle, pemBytes, 0600))
+
+	client, err := NewClient(config.Config{
+		CrawlUserAgent: "test-crawler/1.0",
+		CrawlHeaders:   []string{"Accept: text/plain", "X-Crawler: ads"},
+		CrawlCABundle:  bundle,
+	})
+	require.NoError(t, err)
+
+	portal := &entity.Portal{ID: 1, Protocol: "https", CanonicalName: strings.TrimPrefix(srv.URL, "https://")}
+	c := New(config.Config{}, newTestStore(portal), client)
+	res, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Providers)
+	assert.Equal(t, "test-crawler/1.0", got.Get("User-Agent"))
+	assert.Equal(t, "text/plain", got.Get("Accept"))
+	assert.Equal(t, "ads", got.Get("X-Crawler"))
+	assert.Empty(t, got.Get("Content-Type"))
+
+	tcases := []config.Config{
+		{CrawlProxy: "ftp://proxy.example.com"},
+		{CrawlProxy: "socks5://"},
+		{CrawlHeaders: []string{"no value"}},
+		{CrawlCABundle: filepath.Join(dir, "missing.pem")},
+	}
+	for _, conf := range tcases {
+		_, err := NewClient(conf)
+		assert.Error(t, err, "%+v", conf)
+	}
+	_, err = NewClient(config.Config{CrawlProxy: "socks5://127.0.0.1:1080"})
+	assert.NoError(t, err)
+
+	// The sellers.json files have a read timeout of their own
+	conf := config.Config{CrawlConnectTimeout: time.Second, CrawlReadTimeout: 2 * time.Second, SellersReadTimeout: time.Minute}
+	client, err = NewClient(conf)
+	require.NoError(t, err)
+	assert.Equal(t, 3*time.Second, client.Timeout)
+	client, err = NewSellersClient(conf)
+	require.NoError(t, err)
+	assert.Equal(t, 61*time.Second, client.Timeout)
+}
+
+func TestCrawlPortalDeletedProviders(t *testing.T) {
+	t.Parallel()
+
+	var conditional []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "google.com, pub-1, DIRECT\nappnexus.com, 42, RESELLER\n")
+	}))
+	defer srv.Close()
+
+	portal := testPortal(1, srv)
+	s := newTestStore(portal)
+	c := New(config.Config{}, s, hostFetcher{srv: srv})
+
+	_, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+
+	// The providers are deleted, while the file does not change
+	s.deleteProviders(portal.ID)
+	res, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Empty(t, res.Unchanged)
+	assert.Equal(t, 2, res.Providers)
+	assert.Len(t, s.providers[portal.ID], 2)
+	assert.Equal(t, []string{"", ""}, conditional)
+}
+
+func TestCrawlPortalSnapshotFailed(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "google.com, pub-1, DIRECT\n")
+	}))
+	defer srv.Close()
+
+	portal := testPortal(1, srv)
+	s := newTestStore(portal)
+	s.snapErr = errors.New("connection reset")
+	c := New(config.Config{}, s, hostFetcher{srv: srv})
+
+	_, err := c.CrawlPortal(context.Background(), portal)
+	require.Error(t, err)
+	assert.Empty(t, s.snapshots)
+
+	// The file is not taken as unchanged, so its snapshot is stored by the next crawl
+	s.mu.Lock()
+	s.snapErr = nil
+	s.mu.Unlock()
+	res, err := c.CrawlPortal(context.Background(), portal)
+	require.NoError(t, err)
+	assert.Empty(t, res.Unchanged)
+	require.Len(t, s.snapshots, 1)
+	assert.Equal(t, entity.FileKindAds, s.snapshots[0].FileKind)
+}
+
+func TestStartJobBusy(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("google.com, pub-1, DIRECT\n"))
+	}))
+	defer srv.Close()
+
+	portals := []*entity.Portal{testPortal(1, srv), testPortal(2, srv), testPortal(3, srv)}
+	s := newTestStore(portals...)
+	c := New(config.Config{}, s, srv.Client())
+
+	job, err := c.StartJob(context.Background(), portals[:2])
+	require.NoError(t, err)
+	assert.Equal(t, 2, job.PortalsTotal)
+	assert.True(t, c.Busy(1))
+	assert.True(t, c.Busy(2))
+
+	// Portals of the running job are left out of the next ones
+	_, err = c.StartJob(context.Background(), portals[:1])
+	assert.Equal(t, ErrPortalsBusy, err)
+	other, err := c.StartJob(context.Background(), portals[1:])
+	require.NoError(t, err)
+	assert.Equal(t, 1, other.PortalsTotal)
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Busy(1) || c.Busy(2) || c.Busy(3) {
+		require.True(t, time.Now().Before(deadline), "portals still busy")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCrawlSellersTooLarge(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush() // no Content-Length, the body is cut while decoding
+		fmt.Fprint(w, `{"sellers": [`+strings.Repeat(`{"seller_id": "pub-1", "seller_type": "PUBLISHER"},`, 100)+`{"seller_id": "pub-2"}]}`)
+	}))
+	defer srv.Close()
+
+	s := newTestStore()
+	s.providers[1] = []*entity.Provider{{DomainName: "google.com", AccountID: "pub-1", AccountType: entity.RelationshipDirect}}
+	c := New(config.Config{SellersMaxBodySize: 200}, s, hostFetcher{srv: srv})
+
+	results, err := c.CrawlSellers(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Contains(t, results[0].Error, ErrTooLarge.Error())
+	assert.Empty(t, s.sellers["google.com"])
+
+	// The limit of the ads.txt files does not apply
+	c = New(config.Config{CrawlMaxBodySize: 200, SellersMaxBodySize: 1 << 20}, s, hostFetcher{srv: srv})
+	results, err = c.CrawlSellers(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Empty(t, results[0].Error)
+	assert.Len(t, s.sellers["google.com"], 101)
+}
@@ -0,0 +1,85 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+var (
+	// ErrEmptyFile is returned for a file served without any content
+	ErrEmptyFile = errors.New("empty file")
+	// ErrNotText is returned for a file not served as text/plain, unless such files are only warned about
+	ErrNotText = errors.New("not served as text/plain")
+	// ErrTooLarge is returned for a file exceeding the maximum body size
+	ErrTooLarge = errors.New("file too large")
+)
+
+// StatusError is returned for an unexpected response code
+type StatusError struct {
+	Code int
+	URL  string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response code %v for %v", e.Code, e.URL)
+}
+
+// Classify returns the class of an error of CrawlPortal
+func Classify(err error) entity.ErrorClass {
+	cause := errors.Cause(err)
+	if ue, ok := cause.(*url.Error); ok {
+		if ue.Timeout() {
+			return entity.ErrorTimeout
+		}
+		cause = ue.Err
+	}
+	if cause == context.DeadlineExceeded {
+		return entity.ErrorTimeout
+	}
+	// The dialer wraps the failed lookups of the host
+	if oe, ok := cause.(*net.OpError); ok {
+		if _, ok := oe.Err.(*net.DNSError); ok {
+			return entity.ErrorDNS
+		}
+	}
+	switch e := cause.(type) {
+	case *StatusError:
+		switch {
+		case e.Code >= 500:
+			return entity.ErrorHTTP5xx
+		case e.Code >= 400:
+			return entity.ErrorHTTP4xx
+		}
+		return entity.ErrorOther
+	case *net.DNSError:
+		return entity.ErrorDNS
+	}
+	switch cause {
+	case ErrEmptyFile:
+		return entity.ErrorEmptyFile
+	case ErrNotText:
+		return entity.ErrorNotText
+	case ErrTooLarge:
+		return entity.ErrorTooLarge
+	case ErrRedirectPolicy:
+		return entity.ErrorRedirect
+	}
+	// The TLS and certificate errors have no common type
+	if msg := cause.Error(); strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:") {
+		return entity.ErrorTLS
+	}
+	if ne, ok := cause.(net.Error); ok && ne.Timeout() {
+		return entity.ErrorTimeout
+	}
+	if _, ok := cause.(*net.OpError); ok {
+		return entity.ErrorTCP
+	}
+	return entity.ErrorOther
+}
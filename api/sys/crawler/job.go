@@ -0,0 +1,297 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/api/common"
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// ErrPortalsBusy is returned by StartJob if all the portals are being crawled by other jobs
+var ErrPortalsBusy = errors.New("all portals are being crawled already")
+
+// StartJob enqueues a crawl job over the portals which are not being crawled by another job, and runs it
+// in the background. The portals of the job are busy once it returns. It returns a copy of the job as enqueued,
+// as the job itself is updated in the background, e.g. with the subdomains found.
+func (c *Crawler) StartJob(ctx context.Context, portals []*entity.Portal) (*entity.CrawlJob, error) {
+	portals = c.claimPortals(portals)
+	if len(portals) == 0 {
+		return nil, ErrPortalsBusy
+	}
+	job, err := c.Store.AddCrawlJob(ctx, portals)
+	if err != nil {
+		c.releasePortals(portals)
+		return nil, err
+	}
+	queued := copyJob(job)
+	jobCtx, cancel := context.WithCancel(context.Background())
+	c.trackJob(job.ID, cancel)
+	go c.runJob(jobCtx, job, portals)
+	return queued, nil
+}
+
+func copyJob(job *entity.CrawlJob) *entity.CrawlJob {
+	copied := *job
+	copied.Results = make([]*entity.CrawlResult, len(job.Results))
+	for i, res := range job.Results {
+		r := *res
+		copied.Results[i] = &r
+	}
+	return &copied
+}
+
+// RunJob crawls the portals of the job, persisting the progress after every portal.
+// It returns once the job is finished, failed or cancelled.
+func (c *Crawler) RunJob(ctx context.Context, job *entity.CrawlJob, portals []*entity.Portal) {
+	ctx, cancel := context.WithCancel(ctx)
+	c.trackPortals(portals)
+	c.trackJob(job.ID, cancel)
+	c.runJob(ctx, job, portals)
+}
+
+func (c *Crawler) runJob(ctx context.Context, job *entity.CrawlJob, portals []*entity.Portal) {
+	defer c.untrackJob(job.ID)
+	stop := c.heartbeat(job.ID)
+	defer stop()
+
+	start := time.Now()
+	p := &jobProgress{crawler: c, job: job}
+	job.State = entity.JobRunning
+	job.StartedAt = timePtr(start.UTC())
+	c.saveJob(job)
+
+	err := c.CrawlPortals(ctx, portals, p)
+	if err == nil {
+		err = c.crawlSubdomains(ctx, job, p)
+	}
+
+	job.FinishedAt = timePtr(time.Now().UTC())
+	switch {
+	case ctx.Err() != nil:
+		job.State = entity.JobCancelled
+		job.Message = "cancelled"
+		common.LogInfof("Crawl job %v cancelled after %vs", job.ID, (time.Now().Sub(start)).Seconds())
+	case err != nil:
+		job.State = entity.JobFailed
+		job.Message = err.Error()
+		common.LogErrorf("Crawl job %v failed: %v", job.ID, job.Message)
+	default:
+		job.State = entity.JobDone
+		if job.Failed > 0 {
+			job.Message = fmt.Sprintf("%v of %v portals failed", job.Failed, job.PortalsTotal)
+		}
+		common.LogInfof("Poll completed in %vs, %v of %v portals failed", (time.Now().Sub(start)).Seconds(), job.Failed, job.PortalsTotal)
+	}
+	for _, res := range job.Results {
+		if res.State == entity.JobQueued {
+			res.State = entity.JobCancelled
+			c.saveResult(res)
+			c.releasePortal(res.PortalID)
+		}
+	}
+	c.saveJob(job)
+	c.pruneSnapshots()
+}
+
+// heartbeat records every CrawlJobHeartbeat that the job is still running, until stopped. The jobs without
+// a recent heartbeat are taken as interrupted, see service.FailUnfinishedCrawlJobs.
+func (c *Crawler) heartbeat(id int) (stop func()) {
+	interval := c.Conf.CrawlJobHeartbeat
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.Store.TouchCrawlJob(context.Background(), id); err != nil {
+					common.LogErrorf("failed to record the heartbeat of crawl job %v: %v", id, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// pruneSnapshots deletes the snapshots older than the retention period
+func (c *Crawler) pruneSnapshots() {
+	if c.Conf.SnapshotRetention <= 0 {
+		return
+	}
+	n, err := c.Store.PruneSnapshots(context.Background(), time.Now().UTC().Add(-c.Conf.SnapshotRetention))
+	if err != nil {
+		common.LogErrorf("failed to prune snapshots: %v", err)
+		return
+	}
+	if n > 0 {
+		common.LogInfof("Pruned %v snapshots older than %v", n, c.Conf.SnapshotRetention)
+	}
+}
+
+// CancelJob aborts a crawl job running in this process. It reports false if there is no such job.
+func (c *Crawler) CancelJob(id int) bool {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	cancel, ok := c.jobs[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// Busy reports whether the portal is part of an unfinished job
+func (c *Crawler) Busy(portalID int) bool {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	return c.busy[portalID] > 0
+}
+
+func (c *Crawler) trackJob(id int, cancel context.CancelFunc) {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	c.jobs[id] = cancel
+}
+
+// claimPortals marks the portals which are not busy as busy at once, returning them
+func (c *Crawler) claimPortals(portals []*entity.Portal) []*entity.Portal {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	var idle []*entity.Portal
+	for _, p := range portals {
+		if c.busy[p.ID] == 0 {
+			c.busy[p.ID]++
+			idle = append(idle, p)
+		}
+	}
+	return idle
+}
+
+func (c *Crawler) trackPortals(portals []*entity.Portal) {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	for _, p := range portals {
+		c.busy[p.ID]++
+	}
+}
+
+func (c *Crawler) untrackJob(id int) {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	if cancel, ok := c.jobs[id]; ok {
+		cancel()
+		delete(c.jobs, id)
+	}
+}
+
+func (c *Crawler) releasePortals(portals []*entity.Portal) {
+	for _, p := range portals {
+		c.releasePortal(p.ID)
+	}
+}
+
+func (c *Crawler) releasePortal(portalID int) {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	if c.busy[portalID] <= 1 {
+		delete(c.busy, portalID)
+		return
+	}
+	c.busy[portalID]--
+}
+
+// saveJob persists the job progress. It does not use the job context, so that
+// the final state of a cancelled job is still saved.
+func (c *Crawler) saveJob(job *entity.CrawlJob) {
+	if err := c.Store.UpdateCrawlJob(context.Background(), job); err != nil {
+		common.LogErrorf("failed to save crawl job %v: %v", job.ID, err)
+	}
+}
+
+func (c *Crawler) saveResult(res *entity.CrawlResult) {
+	if err := c.Store.UpdateCrawlResult(context.Background(), res); err != nil {
+		common.LogErrorf("failed to save crawl job %v progress for portal '%v': %v", res.JobID, res.PortalName, err)
+	}
+}
+
+// jobProgress records the outcome of every portal on the job
+type jobProgress struct {
+	crawler    *Crawler
+	mu         sync.Mutex // guards job, its results and discovered
+	job        *entity.CrawlJob
+	discovered []discovered
+}
+
+// discovered are the subdomains declared by a portal
+type discovered struct {
+	parent *entity.Portal
+	names  []string
+}
+
+func (p *jobProgress) Started(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := p.job.Results[i]
+	res.State = entity.JobRunning
+	res.StartedAt = timePtr(time.Now().UTC())
+	p.crawler.saveResult(res)
+}
+
+func (p *jobProgress) Finished(i int, out Result, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := p.job.Results[i]
+	res.Providers = out.Providers
+	res.Errors = len(out.Errors)
+	res.Message = out.Message()
+	res.Fetches = out.Fetches
+	res.Unchanged = err == nil && out.AllUnchanged()
+	res.SoftNotFound = len(out.SoftNotFound) > 0
+	res.StatusCode = out.StatusCode
+	res.Bytes = out.Bytes
+	res.DurationMs = int64(out.Duration / time.Millisecond)
+	res.ErrorClass = ""
+	if len(out.Errors) > 0 {
+		res.ErrorClass = entity.ErrorParse
+	}
+	res.FinishedAt = timePtr(time.Now().UTC())
+	res.State = entity.JobDone
+	res.Outcome = entity.OutcomeOK
+	if out.NotFound {
+		res.Outcome = entity.OutcomeNotFound
+	}
+	if err != nil {
+		res.State = entity.JobFailed
+		res.Outcome = entity.OutcomeError
+		res.Message = err.Error()
+		res.ErrorClass = Classify(err)
+		p.job.Failed++
+	}
+	if err == nil {
+		if names := subdomains(out.Portal, out.Variables); len(names) > 0 {
+			p.discovered = append(p.discovered, discovered{parent: out.Portal, names: names})
+		}
+	}
+	p.job.PortalsDone++
+	p.job.Providers += res.Providers
+	p.job.Errors += res.Errors
+	if res.Unchanged {
+		p.job.Unchanged++
+	}
+	p.crawler.saveResult(res)
+	p.crawler.saveJob(p.job)
+	p.crawler.releasePortal(res.PortalID)
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,130 @@
+package crawler
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostLimiter caps the number of concurrent requests to the same host
+// and keeps a minimum delay between the starts of two consecutive requests to it
+type hostLimiter struct {
+	max   int
+	delay time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostSlots // only the hosts being requested, or whose delay is not over yet
+}
+
+type hostSlots struct {
+	sem   chan struct{}
+	users int // requests holding or waiting for a slot, guarded by hostLimiter.mu
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newHostLimiter(max int, delay time.Duration) *hostLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &hostLimiter{
+		max:   max,
+		delay: delay,
+		hosts: map[string]*hostSlots{},
+	}
+}
+
+// hostKey returns the host a request to the URL is limited by. The port and the protocol are not part of it.
+func hostKey(u *url.URL) string {
+	return strings.ToLower(u.Hostname())
+}
+
+// acquire blocks until a request to the host is allowed. The returned func must be called once the request is done.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	h := l.enter(host)
+	select {
+	case h.sem <- struct{}{}:
+	case <-ctx.Done():
+		l.leave(host, h)
+		return nil, ctx.Err()
+	}
+	release := func() {
+		<-h.sem
+		l.leave(host, h)
+	}
+
+	// Reserve the next start time for this host
+	h.mu.Lock()
+	now := time.Now()
+	start := h.next
+	if start.Before(now) {
+		start = now
+	}
+	h.next = start.Add(l.delay)
+	h.mu.Unlock()
+
+	if wait := start.Sub(now); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+func (l *hostLimiter) enter(host string) *hostSlots {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostSlots{sem: make(chan struct{}, l.max)}
+		l.hosts[host] = h
+	}
+	h.users++
+	return h
+}
+
+// leave forgets the host once no request uses it any more. Its delay is kept till it is over.
+func (l *hostLimiter) leave(host string, h *hostSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h.users--
+	if h.users > 0 {
+		return
+	}
+	h.mu.Lock()
+	wait := h.next.Sub(time.Now())
+	h.mu.Unlock()
+	if wait <= 0 {
+		delete(l.hosts, host)
+		return
+	}
+	time.AfterFunc(wait, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.hosts[host] == h && h.users == 0 {
+			delete(l.hosts, host)
+		}
+	})
+}
+
+// releaseBody releases the slot of the host once the body of its response is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,104 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/api/common"
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// fetch gets a file of the portal over its protocol, falling back to the other protocol on connection
+// and TLS errors, 401 and 403. It returns the URLs requested as get does, and whether the fallback was used.
+func (c *Crawler) fetch(ctx context.Context, portal *entity.Portal, kind entity.FileKind, header http.Header) (*http.Response, []string, bool, error) {
+	resp, chain, err := c.get(ctx, c.Fetcher, portal.Protocol+"://"+portal.CanonicalName+kind.Path(), portal.CanonicalName, header)
+	if !needsFallback(ctx, resp, err) {
+		return resp, chain, false, err
+	}
+
+	// The response is kept in memory, as the other protocol may be served by the same host, whose slot it holds
+	if resp != nil {
+		if err := bufferBody(resp); err != nil {
+			return nil, chain, false, err
+		}
+	}
+	other := otherProtocol(portal.Protocol)
+	resp2, chain2, err2 := c.get(ctx, c.Fetcher, other+"://"+portal.CanonicalName+kind.Path(), portal.CanonicalName, header)
+	if needsFallback(ctx, resp2, err2) {
+		if resp2 != nil {
+			resp2.Body.Close()
+		}
+		common.LogInfof("Fallback to %v failed for %v of portal '%v'", other, kind, portal.CanonicalName)
+		return resp, chain, false, err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	common.LogInfof("Fetched %v of portal '%v' over %v, as %v failed", kind, portal.CanonicalName, other, portal.Protocol)
+	return resp2, chain2, true, err2
+}
+
+// errorBodySize is the number of bytes of an error page kept by bufferBody
+const errorBodySize = 64 << 10
+
+// bufferBody reads the body of an error response, up to errorBodySize bytes, and closes it
+func bufferBody(resp *http.Response) error {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, errorBodySize))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// needsFallback reports whether a request should be retried over the other protocol
+func needsFallback(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		_, ok := errors.Cause(err).(*url.Error)
+		return ok && ctx.Err() == nil
+	}
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+}
+
+func otherProtocol(protocol string) string {
+	if protocol == "https" {
+		return "http"
+	}
+	return "https"
+}
+
+// updateProtocol switches the portal to the other protocol once its files were only fetched over it
+// for a number of consecutive crawls. A crawl succeeding over the protocol of the portal starts the count anew.
+func (c *Crawler) updateProtocol(ctx context.Context, portal *entity.Portal, res *Result) error {
+	fallbacks := 0
+	if res.Fallbacks > 0 && res.Fallbacks == len(res.Fetches) {
+		fallbacks = portal.Fallbacks + 1
+	}
+	protocol := portal.Protocol
+	switchAfter := c.Conf.CrawlProtocolSwitch
+	if switchAfter < 1 {
+		switchAfter = 1
+	}
+	if fallbacks >= switchAfter {
+		protocol = otherProtocol(portal.Protocol)
+		common.LogInfof("Switched portal '%v' from %v to %v after %v consecutive crawls over %v", portal.CanonicalName, portal.Protocol, protocol, fallbacks, protocol)
+		fallbacks = 0
+	}
+	if protocol == portal.Protocol && fallbacks == portal.Fallbacks {
+		return nil
+	}
+
+	if err := c.Store.SetPortalProtocol(ctx, portal.ID, protocol, fallbacks); err != nil {
+		return errors.Wrapf(err, "updating the protocol of portal '%v'", portal.CanonicalName)
+	}
+	portal.Protocol = protocol
+	portal.Fallbacks = fallbacks
+	return nil
+}
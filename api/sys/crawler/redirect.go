@@ -0,0 +1,88 @@
+package crawler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/api/common"
+)
+
+// maxRedirects caps the redirects followed within the root domain
+const maxRedirects = 10
+
+// ErrRedirectPolicy is returned for a redirect forbidden by the ads.txt specification
+var ErrRedirectPolicy = errors.New("redirect not allowed")
+
+// get fetches the URL, following the redirects allowed by the ads.txt specification: any number of them within
+// the root domain, and a single one outside of it, which must not redirect any further.
+// The header is sent with every request. Every request takes a slot of its host, which is held till its
+// response body is closed. It returns the response and the URLs requested, in order, the last one being
+// the URL of the response.
+func (c *Crawler) get(ctx context.Context, f Fetcher, rawURL, root string, header http.Header) (*http.Response, []string, error) {
+	var chain []string
+	outside := false
+	for {
+		chain = append(chain, rawURL)
+		req, err := http.NewRequest("GET", rawURL, nil)
+		if err != nil {
+			return nil, chain, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		release, err := c.limiter.acquire(ctx, hostKey(req.URL))
+		if err != nil {
+			return nil, chain, err
+		}
+		resp, err := f.Do(req.WithContext(ctx))
+		if err != nil {
+			release()
+			return nil, chain, err
+		}
+		if !isRedirect(resp.StatusCode) {
+			resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+			return resp, chain, nil
+		}
+		resp.Body.Close()
+		release()
+
+		// The location is resolved against the requested URL, as the fetcher may have rewritten the request
+		base, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, chain, err
+		}
+		target, err := base.Parse(resp.Header.Get("Location"))
+		if err != nil || target.Host == "" {
+			return nil, chain, errors.Errorf("invalid redirect from %v to '%v'", rawURL, resp.Header.Get("Location"))
+		}
+		if outside {
+			return nil, chain, errors.Wrapf(ErrRedirectPolicy, "%v is outside of the root domain %v and redirects again to %v", rawURL, root, target)
+		}
+		if len(chain) > maxRedirects {
+			return nil, chain, errors.Wrapf(ErrRedirectPolicy, "more than %v redirects from %v", maxRedirects, chain[0])
+		}
+		if !withinDomain(target.Hostname(), root) {
+			outside = true
+		}
+		common.LogInfof("Following redirect %v from %v to %v", resp.StatusCode, rawURL, target)
+		rawURL = target.String()
+	}
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// withinDomain reports whether the host is the root domain or one of its subdomains
+func withinDomain(host, root string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host == root || strings.HasSuffix(host, "."+root)
+}
@@ -0,0 +1,140 @@
+package crawler
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/nettyrnp/ads-crawler/api/common"
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+	"github.com/nettyrnp/ads-crawler/config"
+)
+
+// Scheduler periodically re-crawls the portals which are due
+type Scheduler struct {
+	Crawler  *Crawler
+	Interval time.Duration // default interval between two crawls of a portal
+	Jitter   time.Duration // random extra delay, spreading the crawls over time
+	Tick     time.Duration // how often due portals are looked up
+
+	rnd *rand.Rand
+}
+
+// ScheduleEntry is the upcoming crawl of a portal
+type ScheduleEntry struct {
+	Portal      string     `json:"portal"`
+	Interval    int64      `json:"interval"` // seconds
+	NextCrawlAt *time.Time `json:"nextCrawlAt"`
+	Running     bool       `json:"running"`
+}
+
+func NewScheduler(conf config.Config, c *Crawler) *Scheduler {
+	return &Scheduler{
+		Crawler:  c,
+		Interval: conf.SchedulerInterval,
+		Jitter:   conf.SchedulerJitter,
+		Tick:     conf.SchedulerTick,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Run dispatches the due portals on every tick until ctx is cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	tick := s.Tick
+	if tick <= 0 {
+		tick = time.Minute
+	}
+	common.LogInfof("started crawl scheduler, checking for due portals every %v", tick)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Dispatch(ctx); err != nil {
+			common.LogErrorf("crawl scheduler: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			common.LogInfo("stopped crawl scheduler")
+			return
+		}
+	}
+}
+
+// Dispatch starts a crawl job over the portals which are due and not being crawled already.
+// It returns nil if there is nothing to crawl.
+func (s *Scheduler) Dispatch(ctx context.Context) (*entity.CrawlJob, error) {
+	now := time.Now().UTC()
+	due, err := s.Crawler.Store.GetDuePortals(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var portals []*entity.Portal
+	next := map[int]time.Time{}
+	for _, p := range due {
+		if s.Crawler.Busy(p.ID) {
+			continue
+		}
+		portals = append(portals, p)
+		next[p.ID] = now.Add(s.interval(p) + s.jitter())
+	}
+	if len(portals) == 0 {
+		return nil, nil
+	}
+
+	// Reschedule before crawling, so the portals are not picked up again by the next tick
+	if err := s.Crawler.Store.SetNextCrawls(ctx, next); err != nil {
+		return nil, err
+	}
+	job, err := s.Crawler.StartJob(ctx, portals)
+	if err == ErrPortalsBusy {
+		// A manual poll took the portals meanwhile
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	common.LogInfof("Scheduled crawl job %v for %v due portals", job.ID, len(portals))
+	return job, nil
+}
+
+// Upcoming lists the portals in the order they are going to be crawled
+func (s *Scheduler) Upcoming(ctx context.Context) ([]*ScheduleEntry, error) {
+	portals, err := s.Crawler.Store.GetPortals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*ScheduleEntry, 0, len(portals))
+	for _, p := range portals {
+		entries = append(entries, &ScheduleEntry{
+			Portal:      p.CanonicalName,
+			Interval:    int64(s.interval(p).Seconds()),
+			NextCrawlAt: p.NextCrawlAt,
+			Running:     s.Crawler.Busy(p.ID),
+		})
+	}
+	// Portals never crawled by the scheduler are due right away
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].NextCrawlAt, entries[j].NextCrawlAt
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a.Before(*b)
+	})
+	return entries, nil
+}
+
+func (s *Scheduler) interval(p *entity.Portal) time.Duration {
+	if p.CrawlInterval > 0 {
+		return time.Duration(p.CrawlInterval) * time.Second
+	}
+	return s.Interval
+}
+
+func (s *Scheduler) jitter() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(s.rnd.Int63n(int64(s.Jitter)))
+}
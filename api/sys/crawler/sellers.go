@@ -0,0 +1,140 @@
+package crawler
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/api/common"
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// ErrSellersRunning is returned when the sellers.json files are being crawled already
+var ErrSellersRunning = errors.New("sellers.json crawl is running already")
+
+// SellersResult is the outcome of crawling the sellers.json of an advertising system
+type SellersResult struct {
+	AdSystem string        `json:"adSystem"`
+	Sellers  int           `json:"sellers"`
+	NotFound bool          `json:"notFound"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// CrawlSellers fetches the sellers.json of every advertising system listed by the portals, storing
+// the sellers and re-verifying the providers. A failed advertising system does not stop the others.
+func (c *Crawler) CrawlSellers(ctx context.Context) ([]SellersResult, error) {
+	if !atomic.CompareAndSwapInt32(&c.sellersRunning, 0, 1) {
+		return nil, ErrSellersRunning
+	}
+	defer atomic.StoreInt32(&c.sellersRunning, 0)
+	return c.crawlAllSellers(ctx)
+}
+
+// StartSellers runs CrawlSellers in the background
+func (c *Crawler) StartSellers() error {
+	if !atomic.CompareAndSwapInt32(&c.sellersRunning, 0, 1) {
+		return ErrSellersRunning
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.sellersRunning, 0)
+		if _, err := c.crawlAllSellers(context.Background()); err != nil {
+			common.LogErrorf("sellers.json crawl failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (c *Crawler) crawlAllSellers(ctx context.Context) ([]SellersResult, error) {
+	domains, err := c.Store.GetProviderDomains(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	common.LogInfof("Crawling sellers.json of %v advertising systems", len(domains))
+
+	results := make([]SellersResult, len(domains))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	workers := c.Conf.CrawlConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = c.CrawlSellersOf(ctx, domains[i])
+			}
+		}()
+	}
+feed:
+	for i := range domains {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	common.LogInfof("Crawled sellers.json of %v advertising systems in %vs", len(domains), (time.Now().Sub(start)).Seconds())
+	return results, ctx.Err()
+}
+
+// CrawlSellersOf fetches the sellers.json of a single advertising system. The stored sellers are kept
+// if it could not be fetched, and removed if it is not published.
+func (c *Crawler) CrawlSellersOf(ctx context.Context, adSystem string) SellersResult {
+	start := time.Now()
+	res := SellersResult{AdSystem: adSystem}
+	if err := c.crawlSellers(ctx, &res); err != nil {
+		res.Error = err.Error()
+		common.LogErrorf("Failed to crawl sellers.json of '%v': %v", adSystem, err)
+	}
+	res.Duration = time.Now().Sub(start)
+	return res
+}
+
+func (c *Crawler) crawlSellers(ctx context.Context, res *SellersResult) error {
+	f := c.SellersFetcher
+	if f == nil {
+		f = c.Fetcher
+	}
+	url := "https://" + res.AdSystem + "/sellers.json"
+	resp, _, err := c.get(ctx, f, url, res.AdSystem, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var sellers []*entity.Seller
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		body, err := limitBody(resp, c.Conf.SellersMaxBodySize)
+		if err != nil {
+			return err
+		}
+		sellers, err = entity.ParseSellersJSON(res.AdSystem, body)
+		if err != nil {
+			return err
+		}
+	case resp.StatusCode == http.StatusNotFound:
+		res.NotFound = true
+	default:
+		return &StatusError{Code: resp.StatusCode, URL: url}
+	}
+
+	n, err := c.Store.ReplaceSellers(ctx, res.AdSystem, sellers)
+	if err != nil {
+		return err
+	}
+	res.Sellers = n
+	common.LogInfof("Stored %v sellers of '%v'", n, res.AdSystem)
+	return nil
+}
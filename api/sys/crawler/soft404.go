@@ -0,0 +1,51 @@
+package crawler
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// htmlMarkers start an HTML page, while no line of an ads.txt can start with them
+var htmlMarkers = [][]byte{[]byte("<!doctype html"), []byte("<html"), []byte("<head"), []byte("<body")}
+
+// htmlPage returns why a body served with 2xx is an HTML page rather than an ads.txt, or "" if it is not.
+// Many portals serve their homepage or a styled 404 page at /ads.txt. Only the start of the body counts,
+// as an ads.txt may well mention the markers in its comments.
+func htmlPage(body []byte) string {
+	head := bytes.TrimLeft(body, " \t\r\n\ufeff")
+	if max := len(htmlMarkers[0]); len(head) > max {
+		head = head[:max]
+	}
+	head = bytes.ToLower(head)
+	for _, marker := range htmlMarkers {
+		if bytes.HasPrefix(head, marker) {
+			return fmt.Sprintf("HTML markup '%s'", marker)
+		}
+	}
+	return ""
+}
+
+// softNotFound returns why a parsed file served with 2xx is not an ads.txt, or "" if it is one: an HTML response
+// without any data records, or a file of which the ratio of invalid data records reaches the threshold (0 disables it).
+func softNotFound(contentType string, adsTxt *entity.AdsTxt, threshold float64) string {
+	invalid := map[int]bool{}
+	for _, d := range adsTxt.Diagnostics {
+		if d.Severity == entity.SeverityError {
+			invalid[d.Line] = true
+		}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "text/html" && len(adsTxt.Providers) == 0 && len(invalid) > 0 {
+		return "served as text/html without any data records"
+	}
+	if threshold <= 0 || len(invalid) == 0 {
+		return ""
+	}
+	total := len(invalid) + len(adsTxt.Providers)
+	if ratio := float64(len(invalid)) / float64(total); ratio >= threshold {
+		return fmt.Sprintf("%v of %v data records invalid", len(invalid), total)
+	}
+	return ""
+}
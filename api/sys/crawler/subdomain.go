@@ -0,0 +1,85 @@
+package crawler
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/api/common"
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// subdomains returns the SUBDOMAIN= entries of the portal's ads.txt. Only root portals may declare
+// subdomains, and only their own ones, so that a crawl never leaves the root domain.
+func subdomains(portal *entity.Portal, vars []*entity.Variable) []string {
+	if portal.ParentID != 0 {
+		return nil
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, v := range vars {
+		if v.Name != entity.VarSubdomain {
+			continue
+		}
+		name := entity.NormalizeDomain(v.Value)
+		if !strings.HasSuffix(name, "."+portal.CanonicalName) {
+			common.LogInfof("Ignored SUBDOMAIN=%v of portal '%v', it is not a subdomain of the portal", v.Value, portal.CanonicalName)
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// crawlSubdomains registers the subdomains discovered during the job as child portals
+// and crawls the ones which are not part of the job yet
+func (c *Crawler) crawlSubdomains(ctx context.Context, job *entity.CrawlJob, p *jobProgress) error {
+	inJob := map[int]bool{}
+	for _, res := range job.Results {
+		inJob[res.PortalID] = true
+	}
+
+	var children []*entity.Portal
+	for _, d := range p.discovered {
+		found, err := c.Store.AddSubdomainPortals(ctx, d.parent, d.names)
+		if err != nil {
+			return errors.Wrapf(err, "registering subdomains of portal '%v'", d.parent.CanonicalName)
+		}
+		for _, child := range found {
+			if !inJob[child.ID] {
+				inJob[child.ID] = true
+				children = append(children, child)
+			}
+		}
+	}
+	if len(children) == 0 {
+		return nil
+	}
+
+	offset := len(job.Results)
+	if err := c.Store.AddCrawlResults(ctx, job, children); err != nil {
+		return err
+	}
+	c.trackPortals(children)
+	c.saveJob(job)
+	common.LogInfof("Crawl job %v: crawling %v subdomain portals", job.ID, len(children))
+	return c.CrawlPortals(ctx, children, offsetProgress{Progress: p, offset: offset})
+}
+
+// offsetProgress maps the indices of a later batch of portals onto the job results
+type offsetProgress struct {
+	Progress
+	offset int
+}
+
+func (p offsetProgress) Started(i int) {
+	p.Progress.Started(p.offset + i)
+}
+
+func (p offsetProgress) Finished(i int, res Result, err error) {
+	p.Progress.Finished(p.offset+i, res, err)
+}
@@ -0,0 +1,200 @@
+package entity
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Variables of the ads.txt 1.1 specification
+const (
+	VarContact                = "CONTACT"
+	VarSubdomain              = "SUBDOMAIN"
+	VarManagerDomain          = "MANAGERDOMAIN"
+	VarOwnerDomain            = "OWNERDOMAIN"
+	VarInventoryPartnerDomain = "INVENTORYPARTNERDOMAIN"
+)
+
+// Relationships of the seller to the publisher
+const (
+	RelationshipDirect   = "direct"
+	RelationshipReseller = "reseller"
+)
+
+var knownVariables = map[string]bool{
+	VarContact:                true,
+	VarSubdomain:              true,
+	VarManagerDomain:          true,
+	VarOwnerDomain:            true,
+	VarInventoryPartnerDomain: true,
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+type Severity string
+
+const (
+	SeverityWarning Severity = "warning" // the line is used, but does not follow the specification
+	SeverityError   Severity = "error"   // the line is skipped
+)
+
+// Diagnostic is a problem found on a line of an ads.txt file
+type Diagnostic struct {
+	File     FileKind `json:"file,omitempty"`
+	Line     int      `json:"line"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+func (d Diagnostic) Error() string {
+	if d.File != "" {
+		return fmt.Sprintf("%v line %v: %v: %v", d.File, d.Line, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("line %v: %v: %v", d.Line, d.Severity, d.Message)
+}
+
+// Variable is a 'NAME=value' record of an ads.txt file, stored per portal
+type Variable struct {
+	ID        int       `json:"-" db:"id"`
+	PortalID  int       `json:"portalID" db:"portal_id"`
+	Name      string    `json:"name" db:"name"`
+	Value     string    `json:"value" db:"value"`
+	Line      int       `json:"line" db:"line"`
+	FileKind  FileKind  `json:"fileKind" db:"file_kind"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// AdsTxt is a parsed ads.txt file
+type AdsTxt struct {
+	Providers   []*Provider
+	Variables   []*Variable
+	Diagnostics []Diagnostic
+}
+
+// Errors returns the diagnostics of the skipped lines
+func (a *AdsTxt) Errors() []Diagnostic {
+	var errs []Diagnostic
+	for _, d := range a.Diagnostics {
+		if d.Severity == SeverityError {
+			errs = append(errs, d)
+		}
+	}
+	return errs
+}
+
+func (a *AdsTxt) diagnose(line int, severity Severity, format string, args ...interface{}) {
+	a.Diagnostics = append(a.Diagnostics, Diagnostic{Line: line, Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// ParseAdsTxt parses the content of an ads.txt file following the IAB ads.txt 1.1 specification.
+// Invalid lines are skipped and reported as diagnostics, so the rest of the file is still usable.
+func ParseAdsTxt(data []byte) *AdsTxt {
+	a := &AdsTxt{}
+	data = bytes.TrimPrefix(data, utf8BOM)
+	for i, line := range strings.Split(string(data), "\n") {
+		a.parseLine(i+1, line)
+	}
+	return a
+}
+
+// ParseProvider parses a single data record of an ads.txt file
+func ParseProvider(s string) (*Provider, error) {
+	a := &AdsTxt{}
+	a.parseLine(1, s)
+	if len(a.Providers) == 0 {
+		return nil, ErrInvalidLine
+	}
+	return a.Providers[0], nil
+}
+
+func (a *AdsTxt) parseLine(n int, line string) {
+	line = strings.TrimRight(line, "\r")
+	raw := strings.TrimSpace(line)
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	// A variable has no comma before its '=', unlike a record with an extension such as 'a.com, 1, DIRECT; x=y'
+	if i := strings.Index(line, "="); i >= 0 && !strings.Contains(line[:i], ",") {
+		a.parseVariable(n, line[:i], line[i+1:])
+		return
+	}
+	a.parseRecord(n, line, raw)
+}
+
+func (a *AdsTxt) parseVariable(n int, name, value string) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	value = strings.TrimSpace(value)
+	if name == "" {
+		a.diagnose(n, SeverityError, "variable without a name")
+		return
+	}
+	if value == "" {
+		a.diagnose(n, SeverityError, "variable '%v' has no value", name)
+		return
+	}
+	if !knownVariables[name] {
+		a.diagnose(n, SeverityWarning, "unknown variable '%v'", name)
+	}
+	switch name {
+	case VarSubdomain, VarManagerDomain, VarOwnerDomain, VarInventoryPartnerDomain:
+		// MANAGERDOMAIN may carry a country code after the domain, e.g. 'manager.com, US'
+		domain := strings.TrimSpace(strings.SplitN(value, ",", 2)[0])
+		if err := ValidateDomain(strings.ToLower(domain)); err != nil {
+			a.diagnose(n, SeverityError, "variable '%v': %v '%v'", name, err, domain)
+			return
+		}
+	}
+	a.Variables = append(a.Variables, &Variable{Name: name, Value: value, Line: n})
+}
+
+// parseRecord normalises only the case-insensitive fields, the domain and the relationship.
+// Account and certification authority IDs are kept as listed, since they may be case-sensitive.
+func (a *AdsTxt) parseRecord(n int, line, raw string) {
+	// Extension fields follow a ';' and are not interpreted
+	if i := strings.Index(line, ";"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 3 {
+		a.diagnose(n, SeverityError, "expected at least 3 comma separated fields, got %v", len(fields))
+		return
+	}
+	if len(fields) > 4 {
+		a.diagnose(n, SeverityWarning, "ignored %v fields after the certification authority ID", len(fields)-4)
+	}
+
+	p := &Provider{
+		DomainName:  strings.ToLower(fields[0]),
+		AccountID:   fields[1],
+		AccountType: strings.ToLower(fields[2]),
+		RawLine:     raw,
+	}
+	if len(fields) > 3 {
+		p.CertAuthID = fields[3]
+	}
+	if err := ValidateDomain(p.DomainName); err != nil {
+		a.diagnose(n, SeverityError, "%v '%v' of the advertising system", err, fields[0])
+		return
+	}
+	if p.AccountID == "" {
+		a.diagnose(n, SeverityError, "empty account ID")
+		return
+	}
+	if p.AccountType != RelationshipDirect && p.AccountType != RelationshipReseller {
+		a.diagnose(n, SeverityError, "invalid relationship '%v', expected DIRECT or RESELLER", fields[2])
+		return
+	}
+	if strings.ContainsAny(p.AccountID, " \t") {
+		a.diagnose(n, SeverityWarning, "account ID '%v' contains whitespace", fields[1])
+	}
+	a.Providers = append(a.Providers, p)
+}
@@ -0,0 +1,119 @@
+package entity
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProviderDiff lists the provider changes of a file of the portal between two snapshots
+type ProviderDiff struct {
+	From    *Snapshot         `json:"from"`
+	To      *Snapshot         `json:"to"`
+	Added   []*Provider       `json:"added"`
+	Removed []*Provider       `json:"removed"`
+	Changed []*ProviderChange `json:"changed"`
+}
+
+// ProviderChange is a seller account listed in both snapshots with a different relationship or certification ID
+type ProviderChange struct {
+	From *Provider `json:"from"`
+	To   *Provider `json:"to"`
+}
+
+// SnapshotRef points at a snapshot either by its ID or by a time, meaning the latest snapshot fetched till then
+type SnapshotRef struct {
+	ID int
+	At time.Time
+}
+
+func (r SnapshotRef) String() string {
+	if r.ID != 0 {
+		return "snapshot " + strconv.Itoa(r.ID)
+	}
+	return r.At.Format(time.RFC3339)
+}
+
+// ParseSnapshotRef accepts a snapshot ID, an RFC 3339 time or a date. An empty string points at the latest snapshot.
+func ParseSnapshotRef(s string) (SnapshotRef, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return SnapshotRef{At: time.Now().UTC()}, nil
+	}
+	if id, err := strconv.Atoi(s); err == nil && id > 0 {
+		return SnapshotRef{ID: id}, nil
+	}
+	if at, err := time.Parse(time.RFC3339, s); err == nil {
+		return SnapshotRef{At: at.UTC()}, nil
+	}
+	if at, err := time.Parse("2006-01-02", s); err == nil {
+		return SnapshotRef{At: at}, nil
+	}
+	return SnapshotRef{}, errors.Errorf("invalid crawl point '%v', expected a snapshot ID, an RFC 3339 time or a date", s)
+}
+
+// DiffProviders compares two lists of providers. Entries of the same seller account (advertising system
+// and account ID) which differ in their relationship or certification ID are reported as changed.
+func DiffProviders(from, to []*Provider) *ProviderDiff {
+	diff := &ProviderDiff{Added: []*Provider{}, Removed: []*Provider{}, Changed: []*ProviderChange{}}
+
+	// Identical entries are left out first
+	same := map[string]int{}
+	for _, p := range to {
+		same[providerLine(p)]++
+	}
+	var removed []*Provider
+	for _, p := range from {
+		if line := providerLine(p); same[line] > 0 {
+			same[line]--
+			continue
+		}
+		removed = append(removed, p)
+	}
+	same = map[string]int{}
+	for _, p := range from {
+		same[providerLine(p)]++
+	}
+	var added []*Provider
+	for _, p := range to {
+		if line := providerLine(p); same[line] > 0 {
+			same[line]--
+			continue
+		}
+		added = append(added, p)
+	}
+
+	// The rest is paired by seller account
+	pending := map[string][]*Provider{}
+	for _, p := range removed {
+		key := sellerAccount(p)
+		pending[key] = append(pending[key], p)
+	}
+	for _, p := range added {
+		key := sellerAccount(p)
+		if olds := pending[key]; len(olds) > 0 {
+			diff.Changed = append(diff.Changed, &ProviderChange{From: olds[0], To: p})
+			pending[key] = olds[1:]
+			continue
+		}
+		diff.Added = append(diff.Added, p)
+	}
+	for _, p := range removed {
+		key := sellerAccount(p)
+		if olds := pending[key]; len(olds) > 0 && olds[0] == p {
+			diff.Removed = append(diff.Removed, p)
+			pending[key] = olds[1:]
+		}
+	}
+	return diff
+}
+
+func sellerAccount(p *Provider) string {
+	return strings.ToLower(p.DomainName) + "\x00" + p.AccountID
+}
+
+func providerLine(p *Provider) string {
+	return sellerAccount(p) + "\x00" + strings.ToLower(p.AccountType) + "\x00" + p.CertAuthID
+}
@@ -1,17 +1,15 @@
 package entity
 
 import (
-	"github.com/nettyrnp/ads-crawler/api/common"
 	"github.com/pkg/errors"
 	"regexp"
-	"strings"
 	"time"
 )
 
 var (
-	//reEmail      = regexp.MustCompile(`^(([^<>()\[\]\\.,;:\s@"]+(\.[^<>()\[\]\\.,;:\s@"]+)*)|(".+"))@((\[[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\])|(([a-zA-Z\-0-9]+\.)+[a-zA-Z]{2,}))$`)
-	reComment  = regexp.MustCompile(`#[^#;]+(;|$)`)
-	reProvider = regexp.MustCompile(`^ *([-_.\w]+), *([-_\w]+), *(direct|reseller)(, *([-_.\w]+))? *$`)
+	reEmail  = regexp.MustCompile(`^(([^<>()\[\]\\.,;:\s@"]+(\.[^<>()\[\]\\.,;:\s@"]+)*)|(".+"))@((\[[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\])|(([a-zA-Z\-0-9]+\.)+[a-zA-Z]{2,}))$`)
+	rePhone  = regexp.MustCompile(`^\+?[0-9][-0-9 ()]{4,20}[0-9]$`)
+	reDomain = regexp.MustCompile(`^([a-zA-Z0-9]([-a-zA-Z0-9]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]([-a-zA-Z0-9]{0,61}[a-zA-Z0-9])?$`)
 )
 
 type PortalSortField int
@@ -21,7 +19,20 @@ const (
 	SortByCreationDate
 )
 
-var ErrInvalidLine = errors.New("invalid line")
+var (
+	ErrInvalidLine = errors.New("invalid line")
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("already exists")
+
+	ErrSnapshotMismatch = errors.New("snapshot of another portal or file kind")
+)
+
+const (
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+
+	maxDomainLength = 253
+)
 
 type TPPKind string
 
@@ -29,52 +40,113 @@ const (
 	KindCrawler TPPKind = "Crawler"
 )
 
-//func ValidateEmail(email string) error {
-//	if email == "" {
-//		return errors.New("empty email")
-//	}
-//	if !reEmail.MatchString(email) {
-//		return errors.New("invalid email")
-//	}
-//	return nil
-//}
+func ValidateEmail(email string) error {
+	if email == "" {
+		return errors.New("empty email")
+	}
+	if !reEmail.MatchString(email) {
+		return errors.New("invalid email")
+	}
+	return nil
+}
+
+func ValidatePhone(phone string) error {
+	if phone == "" {
+		return errors.New("empty phone")
+	}
+	if !rePhone.MatchString(phone) {
+		return errors.New("invalid phone, expected digits with an optional leading '+'")
+	}
+	return nil
+}
+
+func ValidateDomain(domain string) error {
+	if domain == "" {
+		return errors.New("empty domain")
+	}
+	if len(domain) > maxDomainLength || !reDomain.MatchString(domain) {
+		return errors.New("invalid domain name")
+	}
+	return nil
+}
 
 type Portal struct {
-	ID int `json:"-", db:"id"`
-	//RawURL string       `json:"rawURL", db:"raw_url"`
-	Protocol      string    `json:"protocol", db:"protocol"`
-	CanonicalName string    `json:"canonicalName", db:"canonical_name"`
-	Email         string    `json:"email", db:"email"`
-	Phone         string    `json:"phone", db:"phone"`
-	CertInfo      string    `json:"certInfo", db:"cert_info"`
-	CreatedAt     time.Time `json:"createdAt",db:"created_at"`
+	ID int `json:"-" db:"id"`
+	//RawURL string       `json:"rawURL" db:"raw_url"`
+	Protocol      string     `json:"protocol" db:"protocol"`
+	CanonicalName string     `json:"canonicalName" db:"canonical_name"`
+	Email         string     `json:"email" db:"email"`
+	Phone         string     `json:"phone" db:"phone"`
+	CertInfo      string     `json:"certInfo" db:"cert_info"`
+	CrawlInterval int        `json:"crawlInterval,omitempty" db:"crawl_interval"` // seconds, 0 for the global default
+	FileKind      FileKind   `json:"fileKind" db:"file_kind"`
+	NextCrawlAt   *time.Time `json:"nextCrawlAt,omitempty" db:"next_crawl_at"`
+	CreatedAt     time.Time  `json:"createdAt" db:"created_at"`
+	ParentID      int        `json:"-" db:"parent_id"`
+	Fallbacks     int        `json:"-" db:"protocol_fallbacks"` // consecutive crawls which only succeeded over the other protocol
+	Parent        string     `json:"parent,omitempty"`          // canonical name of the portal declaring this one as its subdomain
+	Subdomains    []string   `json:"subdomains,omitempty"`      // canonical names of the child portals
 }
 
+// Normalize brings the name and the file kind of the portal to their canonical form, the file kind defaulting to ads.txt
+func (c *Portal) Normalize() {
+	c.CanonicalName = NormalizeDomain(c.CanonicalName)
+	if c.FileKind == "" {
+		c.FileKind = FileKindAds
+	} else if kind, err := ParseFileKind(string(c.FileKind)); err == nil {
+		c.FileKind = kind
+	}
+}
+
+// Validate checks the portal fields, returning ValidationErrors if any of them is invalid.
+// Email, phone and file kind are optional.
 func (c *Portal) Validate() error {
-	var errs []error
+	var errs ValidationErrors
 	if len(c.CanonicalName) == 0 {
-		errs = append(errs, errors.New("CanonicalName cannot be empty"))
+		errs = errs.Add("canonicalName", "CanonicalName cannot be empty")
+	} else if err := ValidateDomain(c.CanonicalName); err != nil {
+		errs = errs.Add("canonicalName", err.Error())
 	}
 	if len(c.Protocol) == 0 {
-		errs = append(errs, errors.New("Protocol cannot be empty"))
+		errs = errs.Add("protocol", "Protocol cannot be empty")
+	} else if c.Protocol != ProtocolHTTP && c.Protocol != ProtocolHTTPS {
+		errs = errs.Add("protocol", "Protocol should be either 'http' or 'https'")
+	}
+	if c.Email != "" {
+		if err := ValidateEmail(c.Email); err != nil {
+			errs = errs.Add("email", err.Error())
+		}
+	}
+	if c.Phone != "" {
+		if err := ValidatePhone(c.Phone); err != nil {
+			errs = errs.Add("phone", err.Error())
+		}
+	}
+	if c.FileKind != "" {
+		if _, err := ParseFileKind(string(c.FileKind)); err != nil {
+			errs = errs.Add("fileKind", err.Error())
+		}
+	}
+	if c.CrawlInterval < 0 {
+		errs = errs.Add("crawlInterval", "CrawlInterval cannot be negative")
 	}
-	//if c.Provider != nil {
-	//	errs = append(errs, c.Provider.validate()...)
-	//}
 	if len(errs) > 0 {
-		return common.JoinErrors(errs)
+		return errs
 	}
 	return nil
 }
 
 type Provider struct {
-	ID          int       `json:"-", db:"id"`
-	DomainName  string    `json:"domainName", db:"domain_name"`
-	AccountID   string    `json:"accountID", db:"account_id"`
-	AccountType string    `json:"accountType", db:"account_Type"`
-	CertAuthID  string    `json:"certAuthID", db:"cert_auth_id"`
-	PortalID    int       `json:"portalID", db:"portal_id"`
-	CreatedAt   time.Time `json:"createdAt", db:"created_at"`
+	ID           int       `json:"-" db:"id"`
+	DomainName   string    `json:"domainName" db:"domain_name"`
+	AccountID    string    `json:"accountID" db:"account_id"`
+	AccountType  string    `json:"accountType" db:"account_Type"`
+	CertAuthID   string    `json:"certAuthID" db:"cert_auth_id"`
+	PortalID     int       `json:"portalID" db:"portal_id"`
+	RawLine      string    `json:"rawLine" db:"raw_line"` // the line of the ads.txt as published
+	FileKind     FileKind  `json:"fileKind" db:"file_kind"`
+	Verification string    `json:"verification" db:"verification"` // one of the Verification* values
+	CreatedAt    time.Time `json:"createdAt" db:"created_at"`
 }
 
 func (c *Provider) validate() []error {
@@ -110,30 +182,3 @@ func (c *Provider) validate() []error {
 	}
 	return nil
 }
-
-func ParseProvider(s string) (*Provider, error) {
-	actual := reComment.ReplaceAllString(s, "")
-	actual = strings.ToLower(actual)
-
-	arr := reProvider.FindStringSubmatch(actual)
-	if len(arr) == 6 {
-		e := &Provider{
-			DomainName:  reProvider.FindStringSubmatch(actual)[1],
-			AccountID:   reProvider.FindStringSubmatch(actual)[2],
-			AccountType: reProvider.FindStringSubmatch(actual)[3],
-			CertAuthID:  reProvider.FindStringSubmatch(actual)[5],
-		}
-		//todo: e.validate()
-		return e, nil
-	}
-	if len(arr) == 4 {
-		e := &Provider{
-			DomainName:  reProvider.FindStringSubmatch(actual)[1],
-			AccountID:   reProvider.FindStringSubmatch(actual)[2],
-			AccountType: reProvider.FindStringSubmatch(actual)[3],
-		}
-		//todo: e.validate()
-		return e, nil
-	}
-	return nil, ErrInvalidLine
-}
@@ -1,9 +1,11 @@
 package entity
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseProvider(t *testing.T) {
@@ -20,18 +22,30 @@ type entry struct {
 
 func testComments() func(t *testing.T) {
 	tcases := []entry{
-		{"#Some comment", ""},
-		{"# Some comment  ", ""},
-		{"#Some comment  ", ""},
-		{"  #Some comment", "  "},
-		{" #Some comment ; abc", "  abc"},
-		{"google.com, pub-5231479214411897, RESELLER, f08c47fec0942fa0 #Some comment", "google.com, pub-5231479214411897, RESELLER, f08c47fec0942fa0 "},
+		{"#Some comment", nil},
+		{"# Some comment  ", nil},
+		{"  #Some comment", nil},
+		{" #Some comment ; abc", nil},
+		{"google.com, pub-5231479214411897, RESELLER, f08c47fec0942fa0 #Some comment", &Provider{
+			DomainName:  "google.com",
+			AccountID:   "pub-5231479214411897",
+			AccountType: "reseller",
+			CertAuthID:  "f08c47fec0942fa0",
+		}},
+		{"google.com, pub-5231479214411897, #Some comment; ReselLER, f08c47fec0942fa0", nil},
 	}
 
 	return func(t *testing.T) {
 		for _, tc := range tcases {
-			actual := reComment.ReplaceAllString(tc.actual, "")
-			require.Equal(t, actual, tc.expected)
+			actualProvider, err := ParseProvider(tc.actual)
+			if tc.expected == nil {
+				require.Equal(t, ErrInvalidLine, err, tc.actual)
+				continue
+			}
+			require.NoError(t, err)
+			expected := *tc.expected.(*Provider)
+			expected.RawLine = strings.TrimSpace(tc.actual)
+			require.Equal(t, &expected, actualProvider)
 		}
 	}
 }
@@ -49,13 +63,24 @@ func testParse() func(t *testing.T) {
 			AccountID:   "pub-5231479214411897",
 			AccountType: "direct",
 		}},
-		{"google.com, pub-5231479214411897, ReselLER, f08c47fec0942fa0 #Some comment", &Provider{
+		{"Google.com, pub-5231479214411897, DIRECT, F08C47FEC0942FA0", &Provider{
+			DomainName:  "google.com",
+			AccountID:   "pub-5231479214411897",
+			AccountType: "direct",
+			CertAuthID:  "F08C47FEC0942FA0",
+		}},
+		{"openx.com, AbC-123xY, reseller", &Provider{
+			DomainName:  "openx.com",
+			AccountID:   "AbC-123xY",
+			AccountType: "reseller",
+		}},
+		{"google.com, pub-5231479214411897, ReselLER, f08c47fec0942fa0\r", &Provider{
 			DomainName:  "google.com",
 			AccountID:   "pub-5231479214411897",
 			AccountType: "reseller",
 			CertAuthID:  "f08c47fec0942fa0",
 		}},
-		{"google.com, pub-5231479214411897, #Some comment; ReselLER, f08c47fec0942fa0 #Another comment", &Provider{
+		{"google.com, pub-5231479214411897, ReselLER, f08c47fec0942fa0;extension=1 #Another comment", &Provider{
 			DomainName:  "google.com",
 			AccountID:   "pub-5231479214411897",
 			AccountType: "reseller",
@@ -65,14 +90,181 @@ func testParse() func(t *testing.T) {
 
 	return func(t *testing.T) {
 		for _, tc := range tcases {
-			actual := reComment.ReplaceAllString(tc.actual, "")
-			actual = strings.ToLower(actual)
-			if !reProvider.MatchString(actual) {
-				t.FailNow()
-			}
-			actualProvider, err := ParseProvider(actual)
+			actualProvider, err := ParseProvider(tc.actual)
 			require.NoError(t, err)
-			require.Equal(t, actualProvider, tc.expected)
+			expected := *tc.expected.(*Provider)
+			expected.RawLine = strings.TrimSpace(tc.actual)
+			require.Equal(t, &expected, actualProvider)
 		}
 	}
 }
+
+func TestParseAdsTxt(t *testing.T) {
+	t.Parallel()
+
+	data := "\xEF\xBB\xBF# ads.txt of example.com\r\n" +
+		"contact=ads@example.com\r\n" +
+		"SUBDOMAIN=news.example.com\r\n" +
+		"MANAGERDOMAIN=manager.com, US\r\n" +
+		"OWNERDOMAIN=not a domain\r\n" +
+		"FOO=bar\r\n" +
+		"\r\n" +
+		"google.com, pub-1, DIRECT, f08c47fec0942fa0; x=y\r\n" +
+		"appnexus.com, 42, RESELLER, abc, extra\r\n" +
+		"appnexus.com, 42\r\n" +
+		"appnexus.com, 42, PARTNER\r\n" +
+		"not_a_domain, 42, DIRECT\r\n"
+	a := ParseAdsTxt([]byte(data))
+
+	require.Len(t, a.Providers, 2)
+	require.Equal(t, "google.com", a.Providers[0].DomainName)
+	require.Equal(t, "f08c47fec0942fa0", a.Providers[0].CertAuthID)
+	require.Equal(t, "abc", a.Providers[1].CertAuthID)
+
+	var vars []string
+	for _, v := range a.Variables {
+		vars = append(vars, v.Name+"="+v.Value)
+	}
+	require.Equal(t, []string{"CONTACT=ads@example.com", "SUBDOMAIN=news.example.com", "MANAGERDOMAIN=manager.com, US", "FOO=bar"}, vars)
+	require.Equal(t, 3, a.Variables[1].Line)
+
+	var diags []string
+	for _, d := range a.Diagnostics {
+		diags = append(diags, fmt.Sprintf("%v %v", d.Line, d.Severity))
+	}
+	require.Equal(t, []string{"5 error", "6 warning", "9 warning", "10 error", "11 error", "12 error"}, diags)
+	require.Len(t, a.Errors(), 4)
+}
+
+func TestPortalValidate(t *testing.T) {
+	t.Parallel()
+
+	valid := Portal{Protocol: "https", CanonicalName: "news.example.co.uk", Email: "admin@example.com", Phone: "+044-1234567"}
+	require.NoError(t, valid.Validate())
+
+	noContacts := Portal{Protocol: "http", CanonicalName: "cnn.com"}
+	require.NoError(t, noContacts.Validate())
+
+	invalid := Portal{Protocol: "ftp", CanonicalName: "not a domain", Email: "admin@", Phone: "call me", FileKind: "zip", CrawlInterval: -1}
+	err := invalid.Validate()
+	require.Error(t, err)
+	verrs, ok := err.(ValidationErrors)
+	require.True(t, ok)
+	var fields []string
+	for _, v := range verrs {
+		fields = append(fields, v.Field)
+	}
+	require.Equal(t, []string{"canonicalName", "protocol", "email", "phone", "fileKind", "crawlInterval"}, fields)
+
+	empty := Portal{}
+	verrs, ok = empty.Validate().(ValidationErrors)
+	require.True(t, ok)
+	require.Len(t, verrs, 2)
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	t.Parallel()
+
+	tcases := []entry{
+		{"cnn.com", "cnn.com"},
+		{"  CNN.com ", "cnn.com"},
+		{"www.cnn.com.", "cnn.com"},
+		{"https://WWW.CNN.com:443/ads.txt", "cnn.com"},
+		{"http://user@cnn.com?x=1", "cnn.com"},
+		{"news.cnn.com", "news.cnn.com"},
+	}
+	for _, tc := range tcases {
+		require.Equal(t, tc.expected, NormalizeDomain(tc.actual))
+	}
+}
+
+func TestParseFileKind(t *testing.T) {
+	t.Parallel()
+
+	kind, err := ParseFileKind(" App-Ads ")
+	require.NoError(t, err)
+	require.Equal(t, FileKindAppAds, kind)
+	require.Equal(t, "/app-ads.txt", kind.Path())
+	require.Equal(t, []FileKind{FileKindAds, FileKindAppAds}, FileKindBoth.Files())
+	require.Equal(t, []FileKind{FileKindAds}, FileKind("").Files())
+	_, err = ParseFileKind("sellers.json")
+	require.Error(t, err)
+
+	p := Portal{CanonicalName: "WWW.Example.com", FileKind: "app-ads"}
+	p.Normalize()
+	require.Equal(t, "example.com", p.CanonicalName)
+	require.Equal(t, FileKindAppAds, p.FileKind)
+}
+
+func TestParseSellersJSON(t *testing.T) {
+	t.Parallel()
+
+	doc := `{"version": "1.0", "sellers": [
+		{"seller_id": "pub-1", "seller_type": "publisher", "name": "Example", "domain": "Example.com"},
+		{"seller_id": 42, "seller_type": "INTERMEDIARY", "is_confidential": 1},
+		{"seller_type": "BOTH", "name": "no id"}
+	]}`
+	sellers, err := ParseSellersJSON("google.com", strings.NewReader(doc))
+	require.NoError(t, err)
+	require.Len(t, sellers, 2)
+	require.Equal(t, &Seller{AdSystem: "google.com", SellerID: "pub-1", SellerType: SellerPublisher, Name: "Example", Domain: "example.com"}, sellers[0])
+	require.Equal(t, "42", sellers[1].SellerID)
+	require.True(t, sellers[1].IsConfidential)
+
+	_, err = ParseSellersJSON("google.com", strings.NewReader("<html>"))
+	require.Error(t, err)
+	_, err = ParseSellersJSON("google.com", strings.NewReader(`{"sellers": {"seller_id": "pub-1"}}`))
+	require.Error(t, err)
+	_, err = ParseSellersJSON("google.com", strings.NewReader(`{"sellers": [{"seller_id": "pub-1"}`))
+	require.Error(t, err)
+
+	// Fields around the sellers are skipped
+	others, err := ParseSellersJSON("google.com", strings.NewReader(`{"contact_email": "a@b.com", "sellers": [{"seller_id": "pub-1"}], "identifiers": [{"name": "TAG-ID", "value": "x"}]}`))
+	require.NoError(t, err)
+	require.Len(t, others, 1)
+	others, err = ParseSellersJSON("google.com", strings.NewReader(`{"version": "1.0"}`))
+	require.NoError(t, err)
+	require.Empty(t, others)
+
+}
+
+func TestDiffProviders(t *testing.T) {
+	t.Parallel()
+
+	from := ParseAdsTxt([]byte("google.com, pub-1, DIRECT, f08c47fec0942fa0\nappnexus.com, 42, RESELLER\nopenx.com, 7, DIRECT\nrubicon.com, 9, DIRECT\n")).Providers
+	to := ParseAdsTxt([]byte("google.com, pub-1, DIRECT, f08c47fec0942fa0\nappnexus.com, 42, DIRECT\nrubicon.com, 9, DIRECT, abc\nindex.com, 5, RESELLER\n")).Providers
+
+	diff := DiffProviders(from, to)
+	require.Len(t, diff.Added, 1)
+	require.Equal(t, "index.com", diff.Added[0].DomainName)
+	require.Len(t, diff.Removed, 1)
+	require.Equal(t, "openx.com", diff.Removed[0].DomainName)
+	require.Len(t, diff.Changed, 2)
+	require.Equal(t, RelationshipReseller, diff.Changed[0].From.AccountType)
+	require.Equal(t, RelationshipDirect, diff.Changed[0].To.AccountType)
+	require.Equal(t, "abc", diff.Changed[1].To.CertAuthID)
+
+	diff = DiffProviders(from, from)
+	require.Empty(t, diff.Added)
+	require.Empty(t, diff.Removed)
+	require.Empty(t, diff.Changed)
+}
+
+func TestParseSnapshotRef(t *testing.T) {
+	t.Parallel()
+
+	ref, err := ParseSnapshotRef("12")
+	require.NoError(t, err)
+	require.Equal(t, SnapshotRef{ID: 12}, ref)
+	ref, err = ParseSnapshotRef("2019-10-01")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC), ref.At)
+	ref, err = ParseSnapshotRef("2019-10-01T12:00:00+02:00")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2019, 10, 1, 10, 0, 0, 0, time.UTC), ref.At)
+	ref, err = ParseSnapshotRef("")
+	require.NoError(t, err)
+	require.False(t, ref.At.IsZero())
+	_, err = ParseSnapshotRef("last week")
+	require.Error(t, err)
+}
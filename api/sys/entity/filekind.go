@@ -0,0 +1,58 @@
+package entity
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileKind is the file of authorised sellers published by a portal
+type FileKind string
+
+const (
+	FileKindAds    FileKind = "ads.txt"     // published on the websites
+	FileKindAppAds FileKind = "app-ads.txt" // published on the developer domain of mobile and CTV apps
+	FileKindBoth   FileKind = "both"        // a portal publishing both files
+)
+
+// ParseFileKind accepts a file kind with or without the '.txt' suffix, e.g. 'app-ads'
+func ParseFileKind(s string) (FileKind, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "ads", string(FileKindAds):
+		return FileKindAds, nil
+	case "app-ads", string(FileKindAppAds):
+		return FileKindAppAds, nil
+	case string(FileKindBoth):
+		return FileKindBoth, nil
+	}
+	return "", errors.Errorf("unknown file kind '%v', expected '%v', '%v' or '%v'", s, FileKindAds, FileKindAppAds, FileKindBoth)
+}
+
+// Files lists the files to fetch for the kind, the default being ads.txt
+func (k FileKind) Files() []FileKind {
+	switch k {
+	case FileKindAppAds:
+		return []FileKind{FileKindAppAds}
+	case FileKindBoth:
+		return []FileKind{FileKindAds, FileKindAppAds}
+	}
+	return []FileKind{FileKindAds}
+}
+
+// PortalFile is the state of the last fetch of a file of the portal, used for conditional requests
+type PortalFile struct {
+	PortalID     int       `json:"-" db:"portal_id"`
+	FileKind     FileKind  `json:"fileKind" db:"file_kind"`
+	ETag         string    `json:"etag,omitempty" db:"etag"`
+	LastModified string    `json:"lastModified,omitempty" db:"last_modified"`
+	SHA256       string    `json:"sha256,omitempty" db:"sha256"` // hex encoded hash of the body, empty if the file was not found
+	Providers    int       `json:"providers" db:"providers"`     // number of providers stored from the file
+	FetchedAt    time.Time `json:"fetchedAt" db:"fetched_at"`
+}
+
+// Path is the URL path of the file
+func (k FileKind) Path() string {
+	return "/" + string(k)
+}
@@ -0,0 +1,43 @@
+package entity
+
+import (
+	"net"
+	"strings"
+)
+
+// ImportReport summarizes a bulk import of portals
+type ImportReport struct {
+	Total     int               `json:"total"`
+	Inserted  int               `json:"inserted"`
+	Updated   int               `json:"updated"`
+	Unchanged int               `json:"unchanged"`
+	Rejected  []ImportRejection `json:"rejected"`
+}
+
+// ImportRejection is a row of an import which was not stored
+type ImportRejection struct {
+	Line   int    `json:"line"`
+	Domain string `json:"domain"`
+	Reason string `json:"reason"`
+}
+
+// NormalizeDomain turns a domain or URL as typed by people (e.g. 'https://WWW.CNN.com:443/ads.txt')
+// into the canonical name of a portal ('cnn.com')
+func NormalizeDomain(s string) string {
+	d := strings.ToLower(strings.TrimSpace(s))
+	if i := strings.Index(d, "://"); i >= 0 {
+		d = d[i+len("://"):]
+	}
+	if i := strings.IndexAny(d, "/?#"); i >= 0 {
+		d = d[:i]
+	}
+	if i := strings.LastIndex(d, "@"); i >= 0 {
+		d = d[i+1:]
+	}
+	if host, _, err := net.SplitHostPort(d); err == nil {
+		d = host
+	}
+	d = strings.TrimSuffix(d, ".")
+	d = strings.TrimPrefix(d, "www.")
+	return d
+}
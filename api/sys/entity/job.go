@@ -0,0 +1,125 @@
+package entity
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobDone      JobState = "done"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Outcome summarizes the crawl of a single portal
+type Outcome string
+
+const (
+	OutcomeOK       Outcome = "ok"
+	OutcomeNotFound Outcome = "not_found" // none of the files of the portal is published
+	OutcomeError    Outcome = "error"     // see the message and the error class of the result
+)
+
+// ErrorClass classifies the failure of a crawl
+type ErrorClass string
+
+const (
+	ErrorDNS       ErrorClass = "dns"
+	ErrorTCP       ErrorClass = "tcp"
+	ErrorTLS       ErrorClass = "tls"
+	ErrorTimeout   ErrorClass = "timeout"
+	ErrorHTTP4xx   ErrorClass = "http_4xx"
+	ErrorHTTP5xx   ErrorClass = "http_5xx"
+	ErrorEmptyFile ErrorClass = "empty_file"
+	ErrorNotText   ErrorClass = "not_text"  // not served as text/plain
+	ErrorTooLarge  ErrorClass = "too_large" // the file exceeds the configured size
+	ErrorParse     ErrorClass = "parse"     // the crawl succeeded, but some lines are invalid
+	ErrorRedirect  ErrorClass = "redirect"  // a redirect forbidden by the ads.txt specification
+	ErrorOther     ErrorClass = "other"
+)
+
+// CrawlJob is a single asynchronous run of the crawler over a set of portals
+type CrawlJob struct {
+	ID           int            `json:"id" db:"id"`
+	State        JobState       `json:"state" db:"state"`
+	PortalsTotal int            `json:"portalsTotal" db:"portals_total"`
+	PortalsDone  int            `json:"portalsDone" db:"portals_done"`
+	Providers    int            `json:"providers" db:"providers"`
+	Errors       int            `json:"errors" db:"errors"`
+	Unchanged    int            `json:"unchanged" db:"unchanged"` // portals whose files did not change since the last crawl
+	Failed       int            `json:"failed" db:"failed"`       // portals which could not be crawled
+	Message      string         `json:"message,omitempty" db:"message"`
+	CreatedAt    time.Time      `json:"createdAt" db:"created_at"`
+	StartedAt    *time.Time     `json:"startedAt,omitempty" db:"started_at"`
+	FinishedAt   *time.Time     `json:"finishedAt,omitempty" db:"finished_at"`
+	Results      []*CrawlResult `json:"portals"`
+}
+
+// CrawlResult tracks the progress of a crawl job on a single portal
+type CrawlResult struct {
+	ID           int        `json:"-" db:"id"`
+	JobID        int        `json:"jobID" db:"job_id"`
+	PortalID     int        `json:"-" db:"portal_id"`
+	PortalName   string     `json:"portal" db:"portal_name"`
+	State        JobState   `json:"state" db:"state"`
+	Outcome      Outcome    `json:"outcome,omitempty" db:"outcome"` // set once the portal is crawled
+	Providers    int        `json:"providers" db:"providers"`
+	Errors       int        `json:"errors" db:"errors"`
+	Unchanged    bool       `json:"unchanged" db:"unchanged"`
+	SoftNotFound bool       `json:"softNotFound" db:"soft_not_found"` // a file served with 2xx was taken as missing
+	Message      string     `json:"message,omitempty" db:"message"`
+	StatusCode   int        `json:"statusCode,omitempty" db:"status_code"` // of the last file fetched
+	ErrorClass   ErrorClass `json:"errorClass,omitempty" db:"error_class"`
+	DurationMs   int64      `json:"durationMs" db:"duration_ms"`
+	Bytes        int64      `json:"bytes" db:"bytes"`
+	Fetches      Fetches    `json:"fetches,omitempty" db:"fetches"`
+	StartedAt    *time.Time `json:"startedAt,omitempty" db:"started_at"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty" db:"finished_at"`
+}
+
+func (j *CrawlJob) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+// FileFetch records where a file of the portal was fetched from
+type FileFetch struct {
+	File       FileKind `json:"file"`
+	URL        string   `json:"url"`                 // final URL, after the redirects
+	Redirects  []string `json:"redirects,omitempty"` // URLs redirected from, in order
+	StatusCode int      `json:"statusCode"`
+	Bytes      int64    `json:"bytes"`
+}
+
+// Fetches are stored as a JSON column
+type Fetches []FileFetch
+
+func (f Fetches) Value() (driver.Value, error) {
+	if f == nil {
+		f = Fetches{}
+	}
+	b, err := json.Marshal(f)
+	return string(b), err
+}
+
+func (f *Fetches) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*f = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into fetches", src)
+	}
+	return json.Unmarshal(b, f)
+}
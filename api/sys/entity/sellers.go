@@ -0,0 +1,138 @@
+package entity
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Seller types of the IAB sellers.json specification
+const (
+	SellerPublisher    = "PUBLISHER"
+	SellerIntermediary = "INTERMEDIARY"
+	SellerBoth         = "BOTH"
+)
+
+// Verification of a provider against the sellers.json of its advertising system
+const (
+	VerificationUnknown      = "unknown"       // the seller is not listed, or the sellers.json was not fetched yet
+	VerificationVerified     = "verified"      // the seller type matches the relationship
+	VerificationTypeMismatch = "type_mismatch" // e.g. a DIRECT line for an INTERMEDIARY seller
+)
+
+// Seller is an entry of the sellers.json published by an advertising system
+type Seller struct {
+	ID             int       `json:"-" db:"id"`
+	AdSystem       string    `json:"adSystem" db:"ad_system"` // domain of the advertising system
+	SellerID       string    `json:"sellerID" db:"seller_id"`
+	SellerType     string    `json:"sellerType" db:"seller_type"`
+	Name           string    `json:"name" db:"name"`
+	Domain         string    `json:"domain" db:"domain"`
+	IsConfidential bool      `json:"isConfidential" db:"is_confidential"`
+	CreatedAt      time.Time `json:"createdAt" db:"created_at"`
+}
+
+// SellerMismatch is a provider whose relationship does not match the type of its seller
+type SellerMismatch struct {
+	Provider   *Provider `json:"provider"`
+	SellerType string    `json:"sellerType"`
+	SellerName string    `json:"sellerName"`
+}
+
+type sellerJSON struct {
+	SellerID       json.RawMessage `json:"seller_id"`
+	SellerType     string          `json:"seller_type"`
+	Name           string          `json:"name"`
+	Domain         string          `json:"domain"`
+	IsConfidential json.RawMessage `json:"is_confidential"`
+}
+
+// ParseSellersJSON reads the sellers of the advertising system. Seller IDs published as numbers
+// are taken as strings, entries without a seller ID are skipped. The body is decoded as a stream,
+// one seller at a time, as the sellers.json of a large exchange takes tens of MB.
+func ParseSellersJSON(adSystem string, r io.Reader) ([]*Seller, error) {
+	sellers, err := decodeSellers(adSystem, json.NewDecoder(r))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sellers.json")
+	}
+	return sellers, nil
+}
+
+func decodeSellers(adSystem string, dec *json.Decoder) ([]*Seller, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	sellers := []*Seller{}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key != "sellers" {
+			// Other fields (contact details, identifiers, version) are skipped
+			var skipped json.RawMessage
+			if err := dec.Decode(&skipped); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			var s sellerJSON
+			if err := dec.Decode(&s); err != nil {
+				return nil, err
+			}
+			id := rawString(s.SellerID)
+			if id == "" {
+				continue
+			}
+			confidential := rawString(s.IsConfidential)
+			sellers = append(sellers, &Seller{
+				AdSystem:       adSystem,
+				SellerID:       id,
+				SellerType:     strings.ToUpper(strings.TrimSpace(s.SellerType)),
+				Name:           s.Name,
+				Domain:         strings.ToLower(strings.TrimSpace(s.Domain)),
+				IsConfidential: confidential == "1" || confidential == "true",
+			})
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	return sellers, nil
+}
+
+// expectDelim reads the next token, which must be the delimiter
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return errors.Errorf("expected '%v', got %v", delim, t)
+	}
+	return nil
+}
+
+// rawString returns a JSON string or number as a string
+func rawString(raw json.RawMessage) string {
+	raw = bytes.TrimSpace(raw)
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return strings.TrimSpace(s)
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	return string(raw)
+}
@@ -0,0 +1,49 @@
+package entity
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot is a distinct body of a file of the portal, as fetched by the crawler.
+// Listed snapshots carry neither the content nor the diagnostics.
+type Snapshot struct {
+	ID          int         `json:"id" db:"id"`
+	PortalID    int         `json:"-" db:"portal_id"`
+	FileKind    FileKind    `json:"fileKind" db:"file_kind"`
+	FetchedAt   time.Time   `json:"fetchedAt" db:"fetched_at"`
+	SHA256      string      `json:"sha256" db:"sha256"`
+	Providers   int         `json:"providers" db:"providers"` // number of providers parsed from the content
+	Content     string      `json:"content,omitempty" db:"content"`
+	Diagnostics Diagnostics `json:"diagnostics,omitempty" db:"diagnostics"`
+}
+
+// Diagnostics are stored as a JSON column
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Value() (driver.Value, error) {
+	if d == nil {
+		d = Diagnostics{}
+	}
+	b, err := json.Marshal(d)
+	return string(b), err
+}
+
+func (d *Diagnostics) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*d = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into diagnostics", src)
+	}
+	return json.Unmarshal(b, d)
+}
@@ -0,0 +1,30 @@
+package entity
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ValidationError describes an invalid field of an entity
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is returned by the validation of entities, listing all invalid fields
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Add(field, msg string) ValidationErrors {
+	return append(e, ValidationError{Field: field, Message: msg})
+}
+
+func (e ValidationErrors) Error() string {
+	var sb bytes.Buffer
+	for _, v := range e {
+		if sb.Len() > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s", v.Field, v.Message))
+	}
+	return sb.String()
+}
@@ -1,33 +1,37 @@
 package http
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/nettyrnp/ads-crawler/api/common"
+	"github.com/nettyrnp/ads-crawler/api/sys/crawler"
 	"github.com/nettyrnp/ads-crawler/api/sys/dto"
 	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+	"github.com/nettyrnp/ads-crawler/api/sys/importer"
 	"github.com/nettyrnp/ads-crawler/api/sys/service"
 	"github.com/nettyrnp/ads-crawler/config"
 	"github.com/pkg/errors"
-	"io/ioutil"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 )
 
 type Controller struct {
-	Kind    string
-	Service service.Service
-	Conf    config.Config
+	Kind      string
+	Service   service.Service
+	Crawler   *crawler.Crawler
+	Scheduler *crawler.Scheduler
+	Conf      config.Config
 }
 
-func New(s service.Service, conf config.Config, kind string) *Controller {
+func New(s service.Service, cr *crawler.Crawler, sch *crawler.Scheduler, conf config.Config, kind string) *Controller {
 	return &Controller{
-		Kind:    kind,
-		Service: s,
-		Conf:    conf,
+		Kind:      kind,
+		Service:   s,
+		Crawler:   cr,
+		Scheduler: sch,
+		Conf:      conf,
 	}
 }
 
@@ -57,7 +61,6 @@ func (c *Controller) Logs(w http.ResponseWriter, r *http.Request) {
 
 func (c *Controller) StartPolling(w http.ResponseWriter, r *http.Request) {
 	svcResp := dto.NewServiceResponse()
-	start := time.Now()
 
 	portals, err := c.Service.GetPortals(r.Context())
 	if err != nil {
@@ -65,88 +68,85 @@ func (c *Controller) StartPolling(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// todo: separate goroutins
-	for _, portal := range portals {
+	// Portals being crawled by another job, e.g. a scheduled one, are skipped
+	job, err := c.Crawler.StartJob(r.Context(), portals)
+	if err == crawler.ErrPortalsBusy {
+		c.respondNotOK(w, http.StatusConflict, svcResp, err.Error())
+		return
+	}
+	if err != nil {
+		c.respondNotOK(w, http.StatusInternalServerError, svcResp, errors.Wrapf(err, "failed to enqueue crawl job").Error())
+		return
+	}
 
-		// Purge before inserting // todo: make purge + batch insert in one transaction
-		err := c.Service.DeleteProvider(r.Context(), portal.CanonicalName)
-		if err != nil {
-			common.LogError(err.Error())
-			c.respondNotOK(w, http.StatusBadRequest, svcResp, err.Error())
-			return
-		}
+	skipped := len(portals) - job.PortalsTotal
+	common.LogInfof("Enqueued crawl job %v for %v portals, skipped %v busy ones", job.ID, job.PortalsTotal, skipped)
+	svcResp.Body = &StartPollResp{JobID: job.ID, Skipped: skipped}
+	respond(w, http.StatusAccepted, svcResp, "")
+}
 
-		url := portal.Protocol + "://" + portal.CanonicalName + "/ads.txt"
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			c.respondNotOK(w, http.StatusInternalServerError, svcResp, err.Error())
-			return
-		}
-		req.Header.Set("Content-Type", "plain/text; charset=utf-8")
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			c.respondNotOK(w, http.StatusInternalServerError, svcResp, err.Error())
-			return
-		}
-		defer res.Body.Close()
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			c.respondNotOK(w, http.StatusInternalServerError, svcResp, err.Error())
-			return
-		}
-		if res.StatusCode >= 200 && res.StatusCode < 300 {
-			bodyStr := string(body)
-			lines := strings.SplitN(bodyStr, "\n", -1) // todo: os.Separator
-			//n:= len(lines)
-			providers := []*entity.Provider{}
-			errs := []error{}
-			for _, line := range lines {
-				provider, parseErr := entity.ParseProvider(line)
-				if parseErr != nil {
-					if parseErr != entity.ErrInvalidLine { // log only specific parse errors
-						errs = append(errs, parseErr)
-					}
-					continue
-				}
-				provider.PortalID = portal.ID
-				provider.CreatedAt = time.Now().UTC()
-
-				// Insert to storage
-				id, err0 := c.Service.AddProvider(r.Context(), provider)
-				if err0 != nil {
-					errs = append(errs, err0)
-					continue
-				}
-				fmt.Printf(">> Inserted id: %v\n", id)
-				providers = append(providers, provider)
-			}
-			common.LogInfof("Got %v lines on portal '%v' [over %v]", len(lines), portal.CanonicalName, portal.Protocol)
-			common.LogInfof("Parsed %v providers for portal '%v'", len(providers), portal.CanonicalName)
-			if len(providers) > 0 {
-				var sb bytes.Buffer
-				for _, p := range providers {
-					sb.WriteString(fmt.Sprintf("%v\n", *p))
-				}
-				common.LogInfof("Providers for portal '%v':\n%v", portal.CanonicalName, sb.String())
-			}
-			if len(errs) > 0 {
-				common.LogErrorf("Errors for portal '%v':\n%v", portal.CanonicalName, common.JoinErrors(errs))
-			}
-
-		} else if res.StatusCode == http.StatusUnauthorized {
-			// try https
-			// ...
-
-		} else if res.StatusCode == http.StatusNotFound {
-			c.Service.NotifyPortalAdmins(r.Context(), portal)
-
-		} else {
-			common.LogErrorf("unexpected response code %v for portal %v", res.StatusCode, url) // todo: LogWarnf
-			return
-		}
+func (c *Controller) StartSellers(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+
+	if err := c.Crawler.StartSellers(); err != nil {
+		c.respondNotOK(w, http.StatusConflict, svcResp, err.Error())
+		return
+	}
+
+	common.LogInfo("Started sellers.json crawl")
+	respond(w, http.StatusAccepted, svcResp, "Started sellers.json crawl")
+}
+
+func (c *Controller) GetCrawlJob(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "invalid job id").Error())
+		return
+	}
+
+	job, err := c.Service.GetCrawlJob(r.Context(), id)
+	if errors.Cause(err) == entity.ErrNotFound {
+		c.respondNotOK(w, http.StatusNotFound, svcResp, fmt.Sprintf("crawl job %v not found", id))
+		return
 	}
-	w.WriteHeader(http.StatusOK)
-	common.LogInfof("Poll completed in %vs", (time.Now().Sub(start)).Seconds())
+	if err != nil {
+		c.respondNotOK(w, http.StatusInternalServerError, svcResp, errors.Wrapf(err, "failed to get crawl job %v", id).Error())
+		return
+	}
+
+	svcResp.Body = job
+	respondOK(w, svcResp, "")
+}
+
+func (c *Controller) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+
+	entries, err := c.Scheduler.Upcoming(r.Context())
+	if err != nil {
+		c.respondNotOK(w, http.StatusInternalServerError, svcResp, errors.Wrap(err, "failed to get crawl schedule").Error())
+		return
+	}
+
+	svcResp.Body = entries
+	respondOK(w, svcResp, "")
+}
+
+func (c *Controller) CancelCrawlJob(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "invalid job id").Error())
+		return
+	}
+
+	if !c.Crawler.CancelJob(id) {
+		c.respondNotOK(w, http.StatusConflict, svcResp, fmt.Sprintf("crawl job %v is not running", id))
+		return
+	}
+	respondOK(w, svcResp, fmt.Sprintf("Cancelling crawl job %v", id))
 }
 
 const (
@@ -209,11 +209,135 @@ func (c *Controller) GetPortalsExt(w http.ResponseWriter, r *http.Request) {
 	respondOK(w, svcResp, "")
 }
 
+func (c *Controller) AddPortal(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+
+	var req portalReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "can't parse request body").Error())
+		return
+	}
+
+	portal := req.toPortal()
+	if _, err := c.Service.AddPortal(r.Context(), portal); err != nil {
+		c.respondPortalError(w, svcResp, portal.CanonicalName, err)
+		return
+	}
+
+	svcResp.Body = portal
+	respond(w, http.StatusCreated, svcResp, fmt.Sprintf("Added portal '%v'", portal.CanonicalName))
+}
+
+func (c *Controller) UpdatePortal(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+	portalName := mux.Vars(r)["name"]
+
+	var portal *entity.Portal
+	if r.Method == http.MethodPatch {
+		var req portalPatchReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "can't parse request body").Error())
+			return
+		}
+		stored, err := c.Service.GetPortal(r.Context(), portalName)
+		if err != nil {
+			c.respondPortalError(w, svcResp, portalName, err)
+			return
+		}
+		req.apply(stored)
+		portal = stored
+	} else {
+		var req portalReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "can't parse request body").Error())
+			return
+		}
+		if req.CanonicalName == "" {
+			req.CanonicalName = portalName
+		}
+		portal = req.toPortal()
+	}
+
+	if err := c.Service.UpdatePortal(r.Context(), portalName, portal); err != nil {
+		c.respondPortalError(w, svcResp, portalName, err)
+		return
+	}
+
+	svcResp.Body = portal
+	respondOK(w, svcResp, fmt.Sprintf("Updated portal '%v'", portalName))
+}
+
+func (c *Controller) DeletePortal(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+	portalName := mux.Vars(r)["name"]
+
+	if err := c.Service.DeletePortal(r.Context(), portalName); err != nil {
+		c.respondPortalError(w, svcResp, portalName, err)
+		return
+	}
+	respondOK(w, svcResp, fmt.Sprintf("Deleted portal '%v' with its providers", portalName))
+}
+
+// maxImportSize limits the size of an uploaded portal list
+const maxImportSize = 64 << 20
+
+func (c *Controller) ImportPortals(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = r.Header.Get("Content-Type")
+	}
+	f, err := importer.ParseFormat(format)
+	if err != nil {
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "expected a 'format' parameter or a content type of csv or jsonl").Error())
+		return
+	}
+
+	report, err := c.Service.ImportPortals(r.Context(), http.MaxBytesReader(w, r.Body, maxImportSize), f)
+	if err != nil {
+		svcResp.Body = report
+		c.respondNotOK(w, http.StatusInternalServerError, svcResp, errors.Wrap(err, "failed to import portals").Error())
+		return
+	}
+
+	svcResp.Body = report
+	respondOK(w, svcResp, fmt.Sprintf("Imported portals: %v inserted, %v updated, %v unchanged, %v rejected",
+		report.Inserted, report.Updated, report.Unchanged, len(report.Rejected)))
+}
+
+// respondPortalError maps the errors of the portal management to response codes.
+// Validation errors are returned in the response body.
+func (c *Controller) respondPortalError(w http.ResponseWriter, svcResp *dto.ServiceResponse, portalName string, err error) {
+	if verrs, ok := errors.Cause(err).(entity.ValidationErrors); ok {
+		svcResp.Body = verrs
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "invalid portal").Error())
+		return
+	}
+	switch errors.Cause(err) {
+	case entity.ErrNotFound:
+		c.respondNotOK(w, http.StatusNotFound, svcResp, fmt.Sprintf("portal '%v' not found", portalName))
+	case entity.ErrConflict:
+		c.respondNotOK(w, http.StatusConflict, svcResp, fmt.Sprintf("portal '%v' already exists", portalName))
+	default:
+		c.respondNotOK(w, http.StatusInternalServerError, svcResp, err.Error())
+	}
+}
+
 func (c *Controller) GetProvidersByPortal(w http.ResponseWriter, r *http.Request) {
 	svcResp := dto.NewServiceResponse()
 	portalName := mux.Vars(r)["name"]
 
-	storedProviders, err := c.Service.GetProvidersByPortal(r.Context(), portalName)
+	var kind entity.FileKind
+	if k := r.URL.Query().Get("fileKind"); k != "" {
+		var err error
+		if kind, err = entity.ParseFileKind(k); err != nil || kind == entity.FileKindBoth {
+			c.respondNotOK(w, http.StatusBadRequest, svcResp, fmt.Sprintf("invalid 'fileKind' parameter '%v', expected '%v' or '%v'", k, entity.FileKindAds, entity.FileKindAppAds))
+			return
+		}
+	}
+
+	storedProviders, err := c.Service.GetProvidersByPortal(r.Context(), portalName, kind)
 	if err != nil {
 		common.LogError(err.Error())
 		c.respondNotOK(w, http.StatusBadRequest, svcResp, err.Error())
@@ -225,6 +349,160 @@ func (c *Controller) GetProvidersByPortal(w http.ResponseWriter, r *http.Request
 	respondOK(w, svcResp, "")
 }
 
+func (c *Controller) GetPortalVariables(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+	portalName := mux.Vars(r)["name"]
+
+	vars, err := c.Service.GetPortalVariables(r.Context(), portalName)
+	if err != nil {
+		c.respondPortalError(w, svcResp, portalName, err)
+		return
+	}
+
+	svcResp.Body = vars
+	common.LogInfof("Retrieved %v ads.txt variables for portalName '%v' from storage", len(vars), portalName)
+	respondOK(w, svcResp, "")
+}
+
+// defaultCrawlsLimit and maxCrawlsLimit bound the page size of the crawl results of a portal
+const (
+	defaultCrawlsLimit = 50
+	maxCrawlsLimit     = 500
+)
+
+func (c *Controller) GetPortalCrawls(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+	portalName := mux.Vars(r)["name"]
+
+	limit, offset := uint64(defaultCrawlsLimit), uint64(0)
+	var err error
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.ParseUint(s, 10, 64); err != nil || limit == 0 || limit > maxCrawlsLimit {
+			c.respondNotOK(w, http.StatusBadRequest, svcResp, fmt.Sprintf("invalid 'limit' parameter '%v', expected 1 to %v", s, maxCrawlsLimit))
+			return
+		}
+	}
+	if s := r.URL.Query().Get("offset"); s != "" {
+		if offset, err = strconv.ParseUint(s, 10, 64); err != nil {
+			c.respondNotOK(w, http.StatusBadRequest, svcResp, fmt.Sprintf("invalid 'offset' parameter '%v'", s))
+			return
+		}
+	}
+
+	crawls, total, err := c.Service.GetPortalCrawls(r.Context(), portalName, limit, offset)
+	if err != nil {
+		c.respondPortalError(w, svcResp, portalName, err)
+		return
+	}
+
+	svcResp.Body = &PortalCrawlsResp{
+		Crawls: crawls,
+		Total:  total,
+	}
+	respondOK(w, svcResp, "")
+}
+
+func (c *Controller) ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+	portalName := mux.Vars(r)["name"]
+
+	snaps, err := c.Service.ListSnapshots(r.Context(), portalName)
+	if err != nil {
+		c.respondPortalError(w, svcResp, portalName, err)
+		return
+	}
+
+	svcResp.Body = snaps
+	common.LogInfof("Retrieved %v snapshots for portalName '%v' from storage", len(snaps), portalName)
+	respondOK(w, svcResp, "")
+}
+
+func (c *Controller) GetSnapshot(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+	portalName := mux.Vars(r)["name"]
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "invalid snapshot id").Error())
+		return
+	}
+
+	snap, err := c.Service.GetSnapshot(r.Context(), portalName, id)
+	if errors.Cause(err) == entity.ErrNotFound {
+		c.respondNotOK(w, http.StatusNotFound, svcResp, fmt.Sprintf("snapshot %v of portal '%v' not found", id, portalName))
+		return
+	}
+	if err != nil {
+		c.respondNotOK(w, http.StatusInternalServerError, svcResp, errors.Wrapf(err, "failed to get snapshot %v", id).Error())
+		return
+	}
+
+	svcResp.Body = snap
+	respondOK(w, svcResp, "")
+}
+
+func (c *Controller) GetProviderDiff(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+	portalName := mux.Vars(r)["name"]
+	query := r.URL.Query()
+
+	var kind entity.FileKind
+	if k := query.Get("fileKind"); k != "" {
+		var err error
+		if kind, err = entity.ParseFileKind(k); err != nil || kind == entity.FileKindBoth {
+			c.respondNotOK(w, http.StatusBadRequest, svcResp, fmt.Sprintf("invalid 'fileKind' parameter '%v', expected '%v' or '%v'", k, entity.FileKindAds, entity.FileKindAppAds))
+			return
+		}
+	}
+	if query.Get("from") == "" {
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, "missing 'from' parameter")
+		return
+	}
+	from, err := entity.ParseSnapshotRef(query.Get("from"))
+	if err != nil {
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "invalid 'from' parameter").Error())
+		return
+	}
+	to, err := entity.ParseSnapshotRef(query.Get("to"))
+	if err != nil {
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, errors.Wrap(err, "invalid 'to' parameter").Error())
+		return
+	}
+
+	diff, err := c.Service.DiffProviders(r.Context(), portalName, kind, from, to)
+	if errors.Cause(err) == entity.ErrNotFound {
+		c.respondNotOK(w, http.StatusNotFound, svcResp, err.Error())
+		return
+	}
+	if errors.Cause(err) == entity.ErrSnapshotMismatch {
+		c.respondNotOK(w, http.StatusBadRequest, svcResp, err.Error())
+		return
+	}
+	if err != nil {
+		c.respondNotOK(w, http.StatusInternalServerError, svcResp, errors.Wrapf(err, "failed to diff the providers of portal '%v'", portalName).Error())
+		return
+	}
+
+	svcResp.Body = diff
+	common.LogInfof("Compared providers of portalName '%v': %v added, %v removed, %v changed", portalName, len(diff.Added), len(diff.Removed), len(diff.Changed))
+	respondOK(w, svcResp, "")
+}
+
+func (c *Controller) GetSellerMismatches(w http.ResponseWriter, r *http.Request) {
+	svcResp := dto.NewServiceResponse()
+	portalName := mux.Vars(r)["name"]
+
+	mismatches, err := c.Service.GetSellerMismatches(r.Context(), portalName)
+	if err != nil {
+		c.respondPortalError(w, svcResp, portalName, err)
+		return
+	}
+
+	svcResp.Body = mismatches
+	common.LogInfof("Retrieved %v sellers.json mismatches for portalName '%v' from storage", len(mismatches), portalName)
+	respondOK(w, svcResp, "")
+}
+
 func (c *Controller) DeleteProvider(w http.ResponseWriter, r *http.Request) {
 	svcResp := dto.NewServiceResponse()
 	portalName := mux.Vars(r)["name"]
@@ -15,3 +15,70 @@ type CustomerPortalsResp struct {
 	Portals []*entity.Portal `json:"portals"`
 	Total   int              `json:"total"`
 }
+
+type PortalCrawlsResp struct {
+	Crawls []*entity.CrawlResult `json:"crawls"`
+	Total  int                   `json:"total"`
+}
+
+type StartPollResp struct {
+	JobID   int `json:"jobID"`
+	Skipped int `json:"skipped"` // portals left out, as other jobs are crawling them
+}
+
+type portalReq struct {
+	Protocol      string `json:"protocol"`
+	CanonicalName string `json:"canonicalName"`
+	Email         string `json:"email"`
+	Phone         string `json:"phone"`
+	CertInfo      string `json:"certInfo"`
+	CrawlInterval int    `json:"crawlInterval"`
+	FileKind      string `json:"fileKind"`
+}
+
+func (r *portalReq) toPortal() *entity.Portal {
+	return &entity.Portal{
+		Protocol:      r.Protocol,
+		CanonicalName: r.CanonicalName,
+		Email:         r.Email,
+		Phone:         r.Phone,
+		CertInfo:      r.CertInfo,
+		CrawlInterval: r.CrawlInterval,
+		FileKind:      entity.FileKind(r.FileKind),
+	}
+}
+
+// portalPatchReq holds the portal fields to change, the absent ones are kept as stored
+type portalPatchReq struct {
+	Protocol      *string `json:"protocol"`
+	CanonicalName *string `json:"canonicalName"`
+	Email         *string `json:"email"`
+	Phone         *string `json:"phone"`
+	CertInfo      *string `json:"certInfo"`
+	CrawlInterval *int    `json:"crawlInterval"`
+	FileKind      *string `json:"fileKind"`
+}
+
+func (r *portalPatchReq) apply(p *entity.Portal) {
+	if r.Protocol != nil {
+		p.Protocol = *r.Protocol
+	}
+	if r.CanonicalName != nil {
+		p.CanonicalName = *r.CanonicalName
+	}
+	if r.Email != nil {
+		p.Email = *r.Email
+	}
+	if r.Phone != nil {
+		p.Phone = *r.Phone
+	}
+	if r.CertInfo != nil {
+		p.CertInfo = *r.CertInfo
+	}
+	if r.CrawlInterval != nil {
+		p.CrawlInterval = *r.CrawlInterval
+	}
+	if r.FileKind != nil {
+		p.FileKind = entity.FileKind(*r.FileKind)
+	}
+}
@@ -0,0 +1,175 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// Format of a portal list
+type Format string
+
+const (
+	FormatCSV       Format = "csv"
+	FormatJSONLines Format = "jsonl"
+)
+
+const maxLineSize = 1024 * 1024
+
+// Row is a portal read from a portal list
+type Row struct {
+	Line   int
+	Domain string         // as found in the list
+	Portal *entity.Portal // its protocol is empty if the list gives none
+}
+
+type jsonRow struct {
+	Domain   string `json:"domain"`
+	Protocol string `json:"protocol"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone"`
+	FileKind string `json:"fileKind"`
+}
+
+// ParseFormat accepts a format name ('csv', 'jsonl', 'ndjson') or a content type of the list
+func ParseFormat(s string) (Format, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if i := strings.Index(s, ";"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	switch s {
+	case "csv", "text/csv":
+		return FormatCSV, nil
+	case "jsonl", "ndjson", "json", "application/x-ndjson", "application/jsonl", "application/json":
+		return FormatJSONLines, nil
+	}
+	return "", errors.Errorf("unsupported portal list format '%v'", s)
+}
+
+// FormatOf guesses the format of a portal list by its file name
+func FormatOf(filename string) (Format, error) {
+	return ParseFormat(strings.TrimPrefix(filepath.Ext(filename), "."))
+}
+
+// Read parses a portal list. Rows which cannot be parsed are returned as rejections,
+// the returned rows still have to be validated.
+func Read(r io.Reader, format Format) ([]*Row, []entity.ImportRejection, error) {
+	switch format {
+	case FormatCSV:
+		return readCSV(r)
+	case FormatJSONLines:
+		return readJSONLines(r)
+	}
+	return nil, nil, errors.Errorf("unsupported portal list format '%v'", format)
+}
+
+// readCSV reads the columns domain, protocol, email, phone and file_kind, in this order or as named by a header row
+func readCSV(r io.Reader) ([]*Row, []entity.ImportRejection, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	columns := map[string]int{"domain": 0, "protocol": 1, "email": 2, "phone": 3, "file_kind": 4}
+	var rows []*Row
+	var rejected []entity.ImportRejection
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				rejected = append(rejected, entity.ImportRejection{Line: line, Reason: err.Error()})
+				continue
+			}
+			return nil, nil, err
+		}
+		if line == 1 && isHeader(record) {
+			columns = map[string]int{}
+			for i, name := range record {
+				name = strings.ToLower(strings.TrimSpace(name))
+				if name == "filekind" {
+					name = "file_kind"
+				}
+				columns[name] = i
+			}
+			if _, ok := columns["domain"]; !ok {
+				return nil, nil, errors.New("the header row has no 'domain' column")
+			}
+			continue
+		}
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		rows = append(rows, newRow(line, field("domain"), field("protocol"), field("email"), field("phone"), field("file_kind")))
+	}
+	return rows, rejected, nil
+}
+
+func readJSONLines(r io.Reader) ([]*Row, []entity.ImportRejection, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	var rows []*Row
+	var rejected []entity.ImportRejection
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var jr jsonRow
+		if err := json.Unmarshal([]byte(text), &jr); err != nil {
+			rejected = append(rejected, entity.ImportRejection{Line: line, Reason: fmt.Sprintf("invalid JSON: %v", err)})
+			continue
+		}
+		rows = append(rows, newRow(line, jr.Domain, jr.Protocol, jr.Email, jr.Phone, jr.FileKind))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return rows, rejected, nil
+}
+
+func newRow(line int, domain, protocol, email, phone, fileKind string) *Row {
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	if protocol == "" {
+		// Take the protocol from a URL given as the domain
+		for _, p := range []string{entity.ProtocolHTTP, entity.ProtocolHTTPS} {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(domain)), p+"://") {
+				protocol = p
+			}
+		}
+	}
+	return &Row{
+		Line:   line,
+		Domain: domain,
+		Portal: &entity.Portal{
+			Protocol:      protocol,
+			CanonicalName: entity.NormalizeDomain(domain),
+			Email:         strings.TrimSpace(email),
+			Phone:         strings.TrimSpace(phone),
+			FileKind:      entity.FileKind(strings.TrimSpace(fileKind)),
+		},
+	}
+}
+
+func isHeader(record []string) bool {
+	for _, name := range record {
+		if strings.ToLower(strings.TrimSpace(name)) == "domain" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCSV(t *testing.T) {
+	t.Parallel()
+
+	t.Run("positional columns", func(t *testing.T) {
+		rows, rejected, err := Read(strings.NewReader("cnn.com,https,admin@cnn.com\nhttps://www.Example.com/\n"), FormatCSV)
+		require.NoError(t, err)
+		assert.Empty(t, rejected)
+		require.Len(t, rows, 2)
+		assert.Equal(t, 1, rows[0].Line)
+		assert.Equal(t, "cnn.com", rows[0].Portal.CanonicalName)
+		assert.Equal(t, "https", rows[0].Portal.Protocol)
+		assert.Equal(t, "admin@cnn.com", rows[0].Portal.Email)
+		assert.Equal(t, "example.com", rows[1].Portal.CanonicalName)
+		assert.Equal(t, "https", rows[1].Portal.Protocol)
+	})
+
+	t.Run("header row", func(t *testing.T) {
+		rows, rejected, err := Read(strings.NewReader("phone,Domain\n+1 555 0100,cnn.com\n\"broken,bbc.com\n"), FormatCSV)
+		require.NoError(t, err)
+		require.Len(t, rows, 1)
+		assert.Equal(t, 2, rows[0].Line)
+		assert.Equal(t, "cnn.com", rows[0].Portal.CanonicalName)
+		assert.Empty(t, rows[0].Portal.Protocol)
+		assert.Equal(t, "+1 555 0100", rows[0].Portal.Phone)
+		require.Len(t, rejected, 1)
+		assert.Equal(t, 3, rejected[0].Line)
+	})
+}
+
+func TestReadJSONLines(t *testing.T) {
+	t.Parallel()
+
+	in := `{"domain": "cnn.com", "protocol": "https"}
+
+not json
+{"domain": "bbc.com", "email": "info@bbc.com"}
+`
+	rows, rejected, err := Read(strings.NewReader(in), FormatJSONLines)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "https", rows[0].Portal.Protocol)
+	assert.Equal(t, 4, rows[1].Line)
+	assert.Equal(t, "info@bbc.com", rows[1].Portal.Email)
+	require.Len(t, rejected, 1)
+	assert.Equal(t, 3, rejected[0].Line)
+}
+
+func TestParseFormat(t *testing.T) {
+	t.Parallel()
+
+	f, err := ParseFormat("text/csv; charset=utf-8")
+	require.NoError(t, err)
+	assert.Equal(t, FormatCSV, f)
+	f, err = FormatOf("portals.ndjson")
+	require.NoError(t, err)
+	assert.Equal(t, FormatJSONLines, f)
+	_, err = ParseFormat("xml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	qu "github.com/Masterminds/squirrel"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// GetPortalFile returns the state of the last fetch of the file of the portal, or entity.ErrNotFound if it was never fetched
+func (r *RDBMSRepository) GetPortalFile(ctx context.Context, portalID int, kind entity.FileKind) (*entity.PortalFile, error) {
+	var file *entity.PortalFile
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select("portal_id", "file_kind", "etag", "last_modified", "sha256", "providers", "fetched_at").
+			From("portal_file").
+			Where(qu.Eq{"portal_id": portalID, "file_kind": fileKindOrDefault(kind)}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		f := &entity.PortalFile{}
+		err = tx.QueryRowContext(ctx, query, args...).
+			Scan(&f.PortalID, &f.FileKind, &f.ETag, &f.LastModified, &f.SHA256, &f.Providers, &f.FetchedAt)
+		if err == sql.ErrNoRows {
+			return entity.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		file = f
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return file, nil
+}
+
+// SavePortalFile stores the state of the last fetch of the file, replacing the previous one
+func (r *RDBMSRepository) SavePortalFile(ctx context.Context, file *entity.PortalFile) error {
+	return r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Insert("portal_file").
+			Columns("portal_id", "file_kind", "etag", "last_modified", "sha256", "providers", "fetched_at").
+			Values(file.PortalID, fileKindOrDefault(file.FileKind), file.ETag, file.LastModified, file.SHA256, file.Providers, file.FetchedAt).
+			Suffix(`ON CONFLICT (portal_id, file_kind) DO UPDATE SET
+				etag = EXCLUDED.etag,
+				last_modified = EXCLUDED.last_modified,
+				sha256 = EXCLUDED.sha256,
+				providers = EXCLUDED.providers,
+				fetched_at = EXCLUDED.fetched_at`).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, args...)
+		return err
+
+	}, sql.LevelReadCommitted)
+}
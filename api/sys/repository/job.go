@@ -0,0 +1,346 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	qu "github.com/Masterminds/squirrel"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// crawlResultsBatchSize keeps the multi-row inserts well below the limit of query parameters
+const crawlResultsBatchSize = 1000
+
+// crawlResultColumns are scanned by scanCrawlResultRows
+var crawlResultColumns = []string{"crawl_result.id", "crawl_result.job_id", "crawl_result.portal_id", "crawl_result.portal_name", "crawl_result.state",
+	"crawl_result.outcome", "crawl_result.providers", "crawl_result.errors", "crawl_result.unchanged", "crawl_result.soft_not_found", "crawl_result.message", "crawl_result.status_code", "crawl_result.error_class",
+	"crawl_result.duration_ms", "crawl_result.bytes", "crawl_result.fetches", "crawl_result.started_at", "crawl_result.finished_at"}
+
+func (r *RDBMSRepository) AddCrawlJob(ctx context.Context, job *entity.CrawlJob) (int, error) {
+	var id int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		query, args, err := psql.Insert("crawl_job").Columns("state", "portals_total", "message", "created_at", "heartbeat_at").
+			Values(job.State, job.PortalsTotal, job.Message, job.CreatedAt, job.CreatedAt).
+			Suffix("RETURNING id").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		var id0 int
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&id0); err != nil {
+			return err
+		}
+
+		if err := insertCrawlResults(ctx, tx, id0, job.Results); err != nil {
+			return err
+		}
+
+		id = id0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return 0, execErr
+	}
+	job.ID = id
+	for _, res := range job.Results {
+		res.JobID = id
+	}
+	return id, nil
+}
+
+// AddCrawlResults adds portals to a stored crawl job, e.g. the subdomains discovered while crawling
+func (r *RDBMSRepository) AddCrawlResults(ctx context.Context, results []*entity.CrawlResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	return r.runInTx(func(tx *sql.Tx) error {
+		return insertCrawlResults(ctx, tx, results[0].JobID, results)
+
+	}, sql.LevelReadCommitted)
+}
+
+// insertCrawlResults adds the results to the job in batches of crawlResultsBatchSize
+func insertCrawlResults(ctx context.Context, tx *sql.Tx, jobID int, results []*entity.CrawlResult) error {
+	psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+	for start := 0; start < len(results); start += crawlResultsBatchSize {
+		end := start + crawlResultsBatchSize
+		if end > len(results) {
+			end = len(results)
+		}
+		insert := psql.Insert("crawl_result").Columns("job_id", "portal_id", "portal_name", "state")
+		for _, res := range results[start:end] {
+			insert = insert.Values(jobID, res.PortalID, res.PortalName, res.State)
+		}
+		query, args, err := insert.ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RDBMSRepository) UpdateCrawlJob(ctx context.Context, job *entity.CrawlJob) error {
+	return r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		query, args, err := psql.Update("crawl_job").
+			SetMap(map[string]interface{}{
+				"state":         job.State,
+				"portals_total": job.PortalsTotal,
+				"portals_done":  job.PortalsDone,
+				"providers":     job.Providers,
+				"errors":        job.Errors,
+				"unchanged":     job.Unchanged,
+				"failed":        job.Failed,
+				"message":       job.Message,
+				"started_at":    job.StartedAt,
+				"finished_at":   job.FinishedAt,
+				"heartbeat_at":  time.Now().UTC(),
+			}).
+			Where(qu.Eq{"id": job.ID}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, args...)
+		return err
+
+	}, sql.LevelReadCommitted)
+}
+
+// TouchCrawlJob records that the job is still being run by its process
+func (r *RDBMSRepository) TouchCrawlJob(ctx context.Context, id int) error {
+	return r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Update("crawl_job").
+			Set("heartbeat_at", time.Now().UTC()).
+			Where(qu.Eq{"id": id}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, args...)
+		return err
+
+	}, sql.LevelReadCommitted)
+}
+
+func (r *RDBMSRepository) UpdateCrawlResult(ctx context.Context, res *entity.CrawlResult) error {
+	return r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		query, args, err := psql.Update("crawl_result").
+			SetMap(map[string]interface{}{
+				"state":          res.State,
+				"outcome":        res.Outcome,
+				"providers":      res.Providers,
+				"errors":         res.Errors,
+				"unchanged":      res.Unchanged,
+				"soft_not_found": res.SoftNotFound,
+				"message":        res.Message,
+				"status_code":    res.StatusCode,
+				"error_class":    res.ErrorClass,
+				"duration_ms":    res.DurationMs,
+				"bytes":          res.Bytes,
+				"fetches":        res.Fetches,
+				"started_at":     res.StartedAt,
+				"finished_at":    res.FinishedAt,
+			}).
+			Where(qu.Eq{"job_id": res.JobID, "portal_id": res.PortalID}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, args...)
+		return err
+
+	}, sql.LevelReadCommitted)
+}
+
+func (r *RDBMSRepository) GetCrawlJob(ctx context.Context, id int) (*entity.CrawlJob, error) {
+	var job *entity.CrawlJob
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		query, args, err := psql.Select("id", "state", "portals_total", "portals_done", "providers", "errors", "unchanged", "failed", "message", "created_at", "started_at", "finished_at").
+			From("crawl_job").
+			Where(qu.Eq{"id": id}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		j := &entity.CrawlJob{}
+		err = tx.QueryRowContext(ctx, query, args...).
+			Scan(&j.ID, &j.State, &j.PortalsTotal, &j.PortalsDone, &j.Providers, &j.Errors, &j.Unchanged, &j.Failed, &j.Message, &j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+		if err == sql.ErrNoRows {
+			return entity.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		query, args, err = psql.Select(crawlResultColumns...).
+			From("crawl_result").
+			Where(qu.Eq{"job_id": id}).
+			OrderBy("portal_name ASC").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		results, err := scanCrawlResultRows(rows, uint64(j.PortalsTotal))
+		if err != nil {
+			return err
+		}
+		j.Results = results
+
+		job = j
+		return nil
+
+	}, sql.LevelRepeatableRead)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return job, nil
+}
+
+// GetPortalCrawls pages through the crawl results of the portal, the latest first, along with their total number
+func (r *RDBMSRepository) GetPortalCrawls(ctx context.Context, portalName string, limit, offset uint64) ([]*entity.CrawlResult, int, error) {
+	var results []*entity.CrawlResult
+	var total int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		query, args, err := psql.Select(crawlResultColumns...).
+			From("crawl_result").
+			Join("portal p ON p.id = crawl_result.portal_id").
+			Where(qu.Eq{"p.canonical_name": portalName}).
+			OrderBy("crawl_result.id DESC").
+			Limit(limit).
+			Offset(offset).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		results0, err := scanCrawlResultRows(rows, limit)
+		if err != nil {
+			return err
+		}
+
+		query, args, err = psql.Select("COUNT(crawl_result.id)").
+			From("crawl_result").
+			Join("portal p ON p.id = crawl_result.portal_id").
+			Where(qu.Eq{"p.canonical_name": portalName}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		var total0 int
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&total0); err != nil {
+			return err
+		}
+
+		results = results0
+		total = total0
+		return nil
+
+	}, sql.LevelRepeatableRead)
+
+	if execErr != nil {
+		return nil, 0, execErr
+	}
+	return results, total, nil
+}
+
+// FailUnfinishedCrawlJobs marks the jobs left queued or running by a process which went away as failed:
+// the ones without a heartbeat since staleBefore. The jobs of the processes still running are left alone.
+func (r *RDBMSRepository) FailUnfinishedCrawlJobs(ctx context.Context, msg string, staleBefore time.Time) (int, error) {
+	var n int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		unfinished := qu.Eq{"state": []entity.JobState{entity.JobQueued, entity.JobRunning}}
+		query, args, err := psql.Update("crawl_job").
+			Set("state", entity.JobFailed).
+			Set("message", msg).
+			Set("finished_at", qu.Expr("NOW()")).
+			Where(unfinished).
+			Where(qu.Lt{"heartbeat_at": staleBefore}).
+			Suffix("RETURNING id").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			return nil
+		}
+
+		query, args, err = psql.Update("crawl_result").
+			Set("state", entity.JobFailed).
+			Set("message", msg).
+			Where(unfinished).
+			Where(qu.Eq{"job_id": ids}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+
+		n = len(ids)
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return 0, execErr
+	}
+	return n, nil
+}
+
+func scanCrawlResultRows(rows *sql.Rows, limit uint64) ([]*entity.CrawlResult, error) {
+	results := make([]*entity.CrawlResult, 0, limit)
+	defer rows.Close()
+	for rows.Next() {
+		e := &entity.CrawlResult{}
+		if err := rows.Scan(&e.ID, &e.JobID, &e.PortalID, &e.PortalName, &e.State, &e.Outcome, &e.Providers, &e.Errors, &e.Unchanged, &e.SoftNotFound, &e.Message,
+			&e.StatusCode, &e.ErrorClass, &e.DurationMs, &e.Bytes, &e.Fetches, &e.StartedAt, &e.FinishedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, e)
+	}
+	return results, nil
+}
@@ -56,5 +56,277 @@ var migrations = &migrate.MemoryMigrationSource{
 				"DROP TYPE IF EXISTS acctypes;",
 			},
 		},
+		{
+			Id: "00002_crawl_jobs",
+			Up: []string{
+				`CREATE TABLE crawl_job (
+                       id serial primary key not null,
+                       state text not null,
+                       portals_total int not null default 0,
+                       portals_done int not null default 0,
+                       providers int not null default 0,
+                       errors int not null default 0,
+                       message text not null default '',
+                       created_at timestamp not null,
+                       started_at timestamp,
+                       finished_at timestamp
+				);`,
+				"CREATE INDEX crawl_job_state_idx ON crawl_job (state);",
+
+				`CREATE TABLE crawl_result (
+                       id serial primary key not null,
+                       job_id int not null references crawl_job(id) on delete cascade,
+                       portal_id int not null,
+                       portal_name text not null,
+                       state text not null,
+                       providers int not null default 0,
+                       errors int not null default 0,
+                       message text not null default '',
+                       started_at timestamp,
+                       finished_at timestamp,
+					   unique(job_id,portal_id)
+				);`,
+			},
+			Down: []string{
+				"DROP TABLE IF EXISTS crawl_result;",
+				"DROP INDEX IF EXISTS crawl_job_state_idx;",
+				"DROP TABLE IF EXISTS crawl_job;",
+			},
+		},
+		{
+			Id: "00003_portal_schedule",
+			Up: []string{
+				"ALTER TABLE portal ADD COLUMN crawl_interval int;",
+				"ALTER TABLE portal ADD COLUMN next_crawl_at timestamp;",
+				"CREATE INDEX portal_next_crawl_idx ON portal (next_crawl_at);",
+			},
+			Down: []string{
+				"DROP INDEX IF EXISTS portal_next_crawl_idx;",
+				"ALTER TABLE portal DROP COLUMN IF EXISTS next_crawl_at;",
+				"ALTER TABLE portal DROP COLUMN IF EXISTS crawl_interval;",
+			},
+		},
+		{
+			// The same seller line may be listed by many portals, so providers are unique per portal only
+			Id: "00004_provider_per_portal",
+			Up: []string{
+				// Providers of unknown portals cannot be kept under the foreign key
+				"DELETE FROM provider WHERE portal_id IS NULL OR portal_id NOT IN (SELECT id FROM portal);",
+				"ALTER TABLE provider DROP CONSTRAINT IF EXISTS provider_domain_name_account_id_account_type_key;",
+				"ALTER TABLE provider ALTER COLUMN portal_id SET NOT NULL;",
+				"ALTER TABLE provider ADD CONSTRAINT provider_portal_id_fkey FOREIGN KEY (portal_id) REFERENCES portal(id) ON DELETE CASCADE;",
+				"ALTER TABLE provider ADD CONSTRAINT provider_portal_id_domain_name_account_id_account_type_key UNIQUE (portal_id,domain_name,account_id,account_type);",
+			},
+			Down: []string{
+				"ALTER TABLE provider DROP CONSTRAINT IF EXISTS provider_portal_id_domain_name_account_id_account_type_key;",
+				"ALTER TABLE provider DROP CONSTRAINT IF EXISTS provider_portal_id_fkey;",
+				"ALTER TABLE provider ALTER COLUMN portal_id DROP NOT NULL;",
+				// Only the first stored copy of a line shared by several portals survives the downgrade
+				`DELETE FROM provider a USING provider b
+					WHERE a.id > b.id AND a.domain_name = b.domain_name AND a.account_id = b.account_id AND a.account_type = b.account_type;`,
+				"ALTER TABLE provider ADD CONSTRAINT provider_domain_name_account_id_account_type_key UNIQUE (domain_name,account_id,account_type);",
+			},
+		},
+		{
+			// Providers stored before have lowercased account IDs, they are repaired by the 'backfill' command
+			Id: "00005_provider_raw_line",
+			Up: []string{
+				"ALTER TABLE provider ADD COLUMN raw_line text;",
+			},
+			Down: []string{
+				"ALTER TABLE provider DROP COLUMN IF EXISTS raw_line;",
+			},
+		},
+		{
+			Id: "00006_portal_variable",
+			Up: []string{
+				`CREATE TABLE portal_variable (
+                       id serial primary key not null,
+                       portal_id int not null references portal(id) on delete cascade,
+                       name text not null,
+                       value text not null,
+                       line int not null default 0,
+                       created_at timestamp not null
+				);`,
+				"CREATE INDEX portal_variable_portal_id_idx ON portal_variable (portal_id);",
+			},
+			Down: []string{
+				"DROP INDEX IF EXISTS portal_variable_portal_id_idx;",
+				"DROP TABLE IF EXISTS portal_variable;",
+			},
+		},
+		{
+			// Subdomains declared by the SUBDOMAIN= variable of a root ads.txt are crawled as child portals
+			Id: "00007_portal_parent",
+			Up: []string{
+				"ALTER TABLE portal ADD COLUMN parent_id int REFERENCES portal(id) ON DELETE CASCADE;",
+				"CREATE INDEX portal_parent_id_idx ON portal (parent_id);",
+			},
+			Down: []string{
+				"DROP INDEX IF EXISTS portal_parent_id_idx;",
+				"ALTER TABLE portal DROP COLUMN IF EXISTS parent_id;",
+			},
+		},
+		{
+			// Portals publish ads.txt, app-ads.txt (apps) or both, the providers and variables are kept per file
+			Id: "00008_file_kind",
+			Up: []string{
+				"ALTER TABLE portal ADD COLUMN file_kind text not null default 'ads.txt';",
+				"ALTER TABLE provider ADD COLUMN file_kind text not null default 'ads.txt';",
+				"ALTER TABLE portal_variable ADD COLUMN file_kind text not null default 'ads.txt';",
+				"ALTER TABLE provider DROP CONSTRAINT IF EXISTS provider_portal_id_domain_name_account_id_account_type_key;",
+				"ALTER TABLE provider ADD CONSTRAINT provider_portal_id_file_kind_domain_name_account_id_account_type_key UNIQUE (portal_id,file_kind,domain_name,account_id,account_type);",
+			},
+			Down: []string{
+				"ALTER TABLE provider DROP CONSTRAINT IF EXISTS provider_portal_id_file_kind_domain_name_account_id_account_type_key;",
+				"DELETE FROM provider WHERE file_kind <> 'ads.txt';",
+				"DELETE FROM portal_variable WHERE file_kind <> 'ads.txt';",
+				"ALTER TABLE provider ADD CONSTRAINT provider_portal_id_domain_name_account_id_account_type_key UNIQUE (portal_id,domain_name,account_id,account_type);",
+				"ALTER TABLE portal_variable DROP COLUMN IF EXISTS file_kind;",
+				"ALTER TABLE provider DROP COLUMN IF EXISTS file_kind;",
+				"ALTER TABLE portal DROP COLUMN IF EXISTS file_kind;",
+			},
+		},
+		{
+			// Sellers listed in the sellers.json of the advertising systems, verifying the providers
+			Id: "00009_sellers",
+			Up: []string{
+				`CREATE TABLE seller (
+                       id serial primary key not null,
+                       ad_system text not null,
+                       seller_id text not null,
+                       seller_type text not null default '',
+                       name text not null default '',
+                       domain text not null default '',
+                       is_confidential boolean not null default false,
+                       created_at timestamp not null,
+                       unique (ad_system, seller_id)
+				);`,
+				"ALTER TABLE provider ADD COLUMN verification text not null default 'unknown';",
+				"CREATE INDEX provider_domain_name_account_id_idx ON provider (domain_name, account_id);",
+			},
+			Down: []string{
+				"DROP INDEX IF EXISTS provider_domain_name_account_id_idx;",
+				"ALTER TABLE provider DROP COLUMN IF EXISTS verification;",
+				"DROP TABLE IF EXISTS seller;",
+			},
+		},
+		{
+			// Final URL and redirect chain of every file fetched for a crawl result
+			Id: "00010_crawl_result_fetches",
+			Up: []string{
+				"ALTER TABLE crawl_result ADD COLUMN fetches jsonb not null default '[]';",
+			},
+			Down: []string{
+				"ALTER TABLE crawl_result DROP COLUMN IF EXISTS fetches;",
+			},
+		},
+		{
+			// Consecutive crawls of a portal which only succeeded over the other protocol
+			Id: "00011_portal_protocol_fallbacks",
+			Up: []string{
+				"ALTER TABLE portal ADD COLUMN protocol_fallbacks int not null default 0;",
+			},
+			Down: []string{
+				"ALTER TABLE portal DROP COLUMN IF EXISTS protocol_fallbacks;",
+			},
+		},
+		{
+			// State of the last fetch of every file, for conditional requests and skipping unchanged files
+			Id: "00012_portal_file",
+			Up: []string{
+				`CREATE TABLE portal_file (
+                       id serial primary key not null,
+                       portal_id int not null references portal(id) on delete cascade,
+                       file_kind text not null,
+                       etag text not null default '',
+                       last_modified text not null default '',
+                       sha256 text not null default '',
+                       providers int not null default 0,
+                       fetched_at timestamp not null,
+                       unique (portal_id, file_kind)
+				);`,
+				"ALTER TABLE crawl_job ADD COLUMN unchanged int not null default 0;",
+				"ALTER TABLE crawl_result ADD COLUMN unchanged boolean not null default false;",
+			},
+			Down: []string{
+				"ALTER TABLE crawl_result DROP COLUMN IF EXISTS unchanged;",
+				"ALTER TABLE crawl_job DROP COLUMN IF EXISTS unchanged;",
+				"DROP TABLE IF EXISTS portal_file;",
+			},
+		},
+		{
+			// Every distinct body of the fetched files
+			Id: "00013_snapshot",
+			Up: []string{
+				`CREATE TABLE snapshot (
+                       id serial primary key not null,
+                       portal_id int not null references portal(id) on delete cascade,
+                       file_kind text not null,
+                       fetched_at timestamp not null,
+                       sha256 text not null,
+                       providers int not null default 0,
+                       content text not null,
+                       diagnostics jsonb not null default '[]'
+				);`,
+				"CREATE INDEX snapshot_portal_id_file_kind_fetched_at_idx ON snapshot (portal_id, file_kind, fetched_at);",
+			},
+			Down: []string{
+				"DROP INDEX IF EXISTS snapshot_portal_id_file_kind_fetched_at_idx;",
+				"DROP TABLE IF EXISTS snapshot;",
+			},
+		},
+		{
+			// Outcome of every crawl of a portal
+			Id: "00014_crawl_result_outcome",
+			Up: []string{
+				"ALTER TABLE crawl_result ADD COLUMN status_code int not null default 0;",
+				"ALTER TABLE crawl_result ADD COLUMN error_class text not null default '';",
+				"ALTER TABLE crawl_result ADD COLUMN duration_ms bigint not null default 0;",
+				"ALTER TABLE crawl_result ADD COLUMN bytes bigint not null default 0;",
+				"CREATE INDEX crawl_result_portal_id_idx ON crawl_result (portal_id);",
+			},
+			Down: []string{
+				"DROP INDEX IF EXISTS crawl_result_portal_id_idx;",
+				"ALTER TABLE crawl_result DROP COLUMN IF EXISTS bytes;",
+				"ALTER TABLE crawl_result DROP COLUMN IF EXISTS duration_ms;",
+				"ALTER TABLE crawl_result DROP COLUMN IF EXISTS error_class;",
+				"ALTER TABLE crawl_result DROP COLUMN IF EXISTS status_code;",
+			},
+		},
+		{
+			// Portals which failed no longer fail the whole crawl job
+			Id: "00015_crawl_outcome",
+			Up: []string{
+				"ALTER TABLE crawl_job ADD COLUMN failed int not null default 0;",
+				"ALTER TABLE crawl_result ADD COLUMN outcome text not null default '';",
+			},
+			Down: []string{
+				"ALTER TABLE crawl_result DROP COLUMN IF EXISTS outcome;",
+				"ALTER TABLE crawl_job DROP COLUMN IF EXISTS failed;",
+			},
+		},
+		{
+			// A file served with 2xx may turn out to be a soft 404
+			Id: "00016_crawl_result_soft_not_found",
+			Up: []string{
+				"ALTER TABLE crawl_result ADD COLUMN soft_not_found boolean not null default false;",
+			},
+			Down: []string{
+				"ALTER TABLE crawl_result DROP COLUMN IF EXISTS soft_not_found;",
+			},
+		},
+		{
+			// Running jobs beat regularly, so that only the jobs of a process which went away are taken as interrupted
+			Id: "00017_crawl_job_heartbeat",
+			Up: []string{
+				"ALTER TABLE crawl_job ADD COLUMN heartbeat_at timestamp;",
+				"UPDATE crawl_job SET heartbeat_at = COALESCE(started_at, created_at);",
+				"ALTER TABLE crawl_job ALTER COLUMN heartbeat_at SET NOT NULL;",
+			},
+			Down: []string{
+				"ALTER TABLE crawl_job DROP COLUMN IF EXISTS heartbeat_at;",
+			},
+		},
 	},
 }
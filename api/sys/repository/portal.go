@@ -0,0 +1,376 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	qu "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+func (r *RDBMSRepository) GetPortal(ctx context.Context, name string) (*entity.Portal, error) {
+	var portal *entity.Portal
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select(portalColumns...).
+			From("portal").
+			Where(qu.Eq{"canonical_name": name}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		portals, err := scanPortalRows(rows, 1)
+		if err != nil {
+			return err
+		}
+		if len(portals) == 0 {
+			return entity.ErrNotFound
+		}
+		portal = portals[0]
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return portal, nil
+}
+
+func (r *RDBMSRepository) AddPortal(ctx context.Context, portal *entity.Portal) (int, error) {
+	var id int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Insert("portal").
+			Columns("protocol", "canonical_name", "email", "phone", "cert_info", "crawl_interval", "file_kind", "created_at", "updated_at").
+			Values(portal.Protocol, portal.CanonicalName, portal.Email, portal.Phone, portal.CertInfo, nullInterval(portal.CrawlInterval), fileKindOrDefault(portal.FileKind), now, now).
+			Suffix("RETURNING id").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		var id0 int
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&id0); err != nil {
+			return conflictOr(err)
+		}
+
+		id = id0
+		portal.CreatedAt = now
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return 0, execErr
+	}
+	portal.ID = id
+	return id, nil
+}
+
+// UpdatePortal overwrites the portal stored under the given canonical name, which may be changed by the update
+func (r *RDBMSRepository) UpdatePortal(ctx context.Context, name string, portal *entity.Portal) error {
+	return r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Update("portal").
+			SetMap(map[string]interface{}{
+				"protocol":       portal.Protocol,
+				"canonical_name": portal.CanonicalName,
+				"email":          portal.Email,
+				"phone":          portal.Phone,
+				"cert_info":      portal.CertInfo,
+				"crawl_interval": nullInterval(portal.CrawlInterval),
+				"file_kind":      fileKindOrDefault(portal.FileKind),
+				"updated_at":     time.Now().UTC(),
+			}).
+			Where(qu.Eq{"canonical_name": name}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return conflictOr(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return entity.ErrNotFound
+		}
+		return nil
+
+	}, sql.LevelReadCommitted)
+}
+
+// DeletePortal removes the portal together with its providers
+func (r *RDBMSRepository) DeletePortal(ctx context.Context, name string) error {
+	return r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Delete("portal").
+			Where(qu.Eq{"canonical_name": name}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return entity.ErrNotFound
+		}
+		return nil
+
+	}, sql.LevelReadCommitted)
+}
+
+// nullInterval stores the default crawl interval as NULL
+func nullInterval(seconds int) interface{} {
+	if seconds <= 0 {
+		return nil
+	}
+	return seconds
+}
+
+// conflictOr maps the violation of a unique constraint to entity.ErrConflict
+func conflictOr(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		return entity.ErrConflict
+	}
+	return err
+}
+
+// portalsBatchSize is the number of portals upserted in one transaction
+const portalsBatchSize = 500
+
+// UpsertPortals inserts the new portals and updates the stored ones, keeping their contacts, protocol and file kind
+// if none are given. New portals without a protocol are crawled over http, without a file kind for their ads.txt.
+// It returns the number of inserted and actually changed portals.
+func (r *RDBMSRepository) UpsertPortals(ctx context.Context, portals []*entity.Portal) (int, int, error) {
+	var inserted, updated int
+	for start := 0; start < len(portals); start += portalsBatchSize {
+		end := start + portalsBatchSize
+		if end > len(portals) {
+			end = len(portals)
+		}
+		ins, upd, err := r.upsertPortals(ctx, portals[start:end])
+		if err != nil {
+			return inserted, updated, err
+		}
+		inserted += ins
+		updated += upd
+	}
+	return inserted, updated, nil
+}
+
+func (r *RDBMSRepository) upsertPortals(ctx context.Context, portals []*entity.Portal) (int, int, error) {
+	var inserted, updated int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		stored, err := storedPortalNames(ctx, tx, portals)
+		if err != nil {
+			return err
+		}
+
+		// The defaults only apply to new portals, an empty value keeps the one of a stored portal
+		now := time.Now().UTC()
+		insert := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Insert("portal").
+			Columns("protocol", "canonical_name", "email", "phone", "file_kind", "created_at", "updated_at")
+		for _, p := range portals {
+			protocol, kind := p.Protocol, p.FileKind
+			if !stored[p.CanonicalName] {
+				if protocol == "" {
+					protocol = entity.ProtocolHTTP
+				}
+				kind = fileKindOrDefault(kind)
+			}
+			insert = insert.Values(protocol, p.CanonicalName, p.Email, p.Phone, kind, now, now)
+		}
+		query, args, err := insert.Suffix(`ON CONFLICT (canonical_name) DO UPDATE SET
+				protocol = COALESCE(NULLIF(EXCLUDED.protocol, ''), portal.protocol),
+				email = COALESCE(NULLIF(EXCLUDED.email, ''), portal.email),
+				phone = COALESCE(NULLIF(EXCLUDED.phone, ''), portal.phone),
+				file_kind = COALESCE(NULLIF(EXCLUDED.file_kind, ''), portal.file_kind),
+				updated_at = EXCLUDED.updated_at
+			WHERE (portal.protocol, portal.email, portal.phone, portal.file_kind) IS DISTINCT FROM
+				(COALESCE(NULLIF(EXCLUDED.protocol, ''), portal.protocol), COALESCE(NULLIF(EXCLUDED.email, ''), portal.email), COALESCE(NULLIF(EXCLUDED.phone, ''), portal.phone),
+				COALESCE(NULLIF(EXCLUDED.file_kind, ''), portal.file_kind))
+			RETURNING (xmax = 0) AS inserted`).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var ins, upd int
+		for rows.Next() {
+			var isNew bool
+			if err := rows.Scan(&isNew); err != nil {
+				return err
+			}
+			if isNew {
+				ins++
+			} else {
+				upd++
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		inserted, updated = ins, upd
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return 0, 0, execErr
+	}
+	return inserted, updated, nil
+}
+
+// storedPortalNames returns which of the portals are stored already
+func storedPortalNames(ctx context.Context, tx *sql.Tx, portals []*entity.Portal) (map[string]bool, error) {
+	names := make([]string, len(portals))
+	for i, p := range portals {
+		names[i] = p.CanonicalName
+	}
+	query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+		Select("canonical_name").
+		From("portal").
+		Where(qu.Eq{"canonical_name": names}).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stored := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		stored[name] = true
+	}
+	return stored, rows.Err()
+}
+
+// GetPortalsWithoutRawLines returns the portals having providers stored before their raw lines were kept
+func (r *RDBMSRepository) GetPortalsWithoutRawLines(ctx context.Context) ([]*entity.Portal, error) {
+	var portals []*entity.Portal
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select(portalColumns...).
+			From("portal").
+			Where("EXISTS (SELECT 1 FROM provider WHERE provider.portal_id = portal.id AND provider.raw_line IS NULL)").
+			OrderBy("canonical_name").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		portals0, err := scanPortalRows(rows, 0)
+		if err != nil {
+			return err
+		}
+		portals = portals0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return portals, nil
+}
+
+// AddSubdomainPortals registers the subdomains declared by the parent portal as its child portals, inheriting
+// its protocol and contacts. Known portals are linked to the parent unless they have one already.
+// It returns the child portals of the parent among the given names.
+func (r *RDBMSRepository) AddSubdomainPortals(ctx context.Context, parent *entity.Portal, names []string) ([]*entity.Portal, error) {
+	var portals []*entity.Portal
+	if len(names) == 0 {
+		return portals, nil
+	}
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		now := time.Now().UTC()
+		insert := psql.Insert("portal").
+			Columns("protocol", "canonical_name", "email", "phone", "file_kind", "parent_id", "created_at", "updated_at")
+		for _, name := range names {
+			insert = insert.Values(parent.Protocol, name, parent.Email, parent.Phone, fileKindOrDefault(parent.FileKind), parent.ID, now, now)
+		}
+		query, args, err := insert.Suffix("ON CONFLICT (canonical_name) DO NOTHING").ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+
+		query, args, err = psql.Update("portal").
+			Set("parent_id", parent.ID).
+			Set("updated_at", now).
+			Where(qu.And{qu.Eq{"canonical_name": names, "parent_id": nil}, qu.NotEq{"id": parent.ID}}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+
+		query, args, err = psql.Select(portalColumns...).
+			From("portal").
+			Where(qu.Eq{"canonical_name": names, "parent_id": parent.ID}).
+			OrderBy("canonical_name").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		portals0, err := scanPortalRows(rows, uint64(len(names)))
+		if err != nil {
+			return err
+		}
+		portals = portals0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return portals, nil
+}
@@ -3,8 +3,10 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"time"
+
 	qu "github.com/Masterminds/squirrel"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	migrate "github.com/rubenv/sql-migrate"
 
@@ -16,12 +18,51 @@ type Config struct {
 	DSN    string
 }
 
+// portalColumns are scanned by scanPortalRows, selecting from the 'portal' table
+var portalColumns = []string{"id", "protocol", "canonical_name", "email", "phone", "cert_info", "COALESCE(crawl_interval, 0)", "next_crawl_at", "created_at", "file_kind",
+	"COALESCE(parent_id, 0)", "protocol_fallbacks",
+	"COALESCE((SELECT pp.canonical_name FROM portal pp WHERE pp.id = portal.parent_id), '')",
+	"ARRAY(SELECT c.canonical_name FROM portal c WHERE c.parent_id = portal.id ORDER BY c.canonical_name)",
+}
+
 type Repository interface {
 	GetPortals(ctx context.Context) ([]*entity.Portal, error)
 	GetPortalsExt(ctx context.Context, opts PortalsQueryOpts) ([]*entity.Portal, int, error)
 	AddProvider(ctx context.Context, provider *entity.Provider) (int, error)
 	DeleteProvider(ctx context.Context, portalID string) error
-	GetProvidersByPortal(ctx context.Context, portalName string) ([]*entity.Provider, error)
+	ReplaceProviders(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider) (int, error)
+	GetProvidersByPortal(ctx context.Context, portalName string, kind entity.FileKind) ([]*entity.Provider, error)
+	GetPortalsWithoutRawLines(ctx context.Context) ([]*entity.Portal, error)
+	ReplacePortalVariables(ctx context.Context, portalID int, kind entity.FileKind, vars []*entity.Variable) error
+	ReplaceProvidersAndVariables(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider, vars []*entity.Variable) (int, error)
+	GetPortalVariables(ctx context.Context, portalName string) ([]*entity.Variable, error)
+	AddSubdomainPortals(ctx context.Context, parent *entity.Portal, names []string) ([]*entity.Portal, error)
+	AddCrawlResults(ctx context.Context, results []*entity.CrawlResult) error
+	GetProviderDomains(ctx context.Context) ([]string, error)
+	ReplaceSellers(ctx context.Context, adSystem string, sellers []*entity.Seller) (int, error)
+	GetSellerMismatches(ctx context.Context, portalName string) ([]*entity.SellerMismatch, error)
+	AddCrawlJob(ctx context.Context, job *entity.CrawlJob) (int, error)
+	UpdateCrawlJob(ctx context.Context, job *entity.CrawlJob) error
+	UpdateCrawlResult(ctx context.Context, res *entity.CrawlResult) error
+	TouchCrawlJob(ctx context.Context, id int) error
+	GetCrawlJob(ctx context.Context, id int) (*entity.CrawlJob, error)
+	GetPortal(ctx context.Context, name string) (*entity.Portal, error)
+	AddPortal(ctx context.Context, portal *entity.Portal) (int, error)
+	UpdatePortal(ctx context.Context, name string, portal *entity.Portal) error
+	DeletePortal(ctx context.Context, name string) error
+	UpsertPortals(ctx context.Context, portals []*entity.Portal) (int, int, error)
+	FailUnfinishedCrawlJobs(ctx context.Context, msg string, staleBefore time.Time) (int, error)
+	GetDuePortals(ctx context.Context, till time.Time) ([]*entity.Portal, error)
+	SetNextCrawls(ctx context.Context, next map[int]time.Time) error
+	SetPortalProtocol(ctx context.Context, portalID int, protocol string, fallbacks int) error
+	GetPortalFile(ctx context.Context, portalID int, kind entity.FileKind) (*entity.PortalFile, error)
+	SavePortalFile(ctx context.Context, file *entity.PortalFile) error
+	AddSnapshot(ctx context.Context, snap *entity.Snapshot) (bool, error)
+	ListSnapshots(ctx context.Context, portalName string) ([]*entity.Snapshot, error)
+	GetSnapshot(ctx context.Context, portalName string, id int) (*entity.Snapshot, error)
+	GetPortalCrawls(ctx context.Context, portalName string, limit, offset uint64) ([]*entity.CrawlResult, int, error)
+	GetSnapshotAt(ctx context.Context, portalName string, kind entity.FileKind, at time.Time) (*entity.Snapshot, error)
+	PruneSnapshots(ctx context.Context, before time.Time) (int, error)
 }
 
 type RDBMSRepository struct {
@@ -35,7 +76,7 @@ func (r *RDBMSRepository) GetPortals(ctx context.Context) ([]*entity.Portal, err
 
 	execErr := r.runInTx(func(tx *sql.Tx) error {
 		selectPortals := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
-			Select("id", "protocol", "canonical_name", "email", "phone", "cert_info", "created_at").From("portal")
+			Select(portalColumns...).From("portal")
 		query, args, err := selectPortals.ToSql()
 		if err != nil {
 			return err
@@ -73,7 +114,7 @@ func (r *RDBMSRepository) GetPortalsExt(ctx context.Context, opts PortalsQueryOp
 			orderBy = ordering[opts.SortBy] + " DESC"
 		}
 		selectPortals := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
-			Select("id", "protocol", "canonical_name", "email", "phone", "cert_info", "created_at").From("portal")
+			Select(portalColumns...).From("portal")
 		if !opts.From.IsZero() && !opts.To.IsZero() {
 			selectPortals = selectPortals.Where(qu.And{qu.GtOrEq{"created_at": opts.From}, qu.LtOrEq{"created_at": opts.To}})
 		}
@@ -114,7 +155,8 @@ func (r *RDBMSRepository) GetPortalsExt(ctx context.Context, opts PortalsQueryOp
 	return portals, total, nil
 }
 
-func (r *RDBMSRepository) GetProvidersByPortal(ctx context.Context, portalName string) ([]*entity.Provider, error) {
+// GetProvidersByPortal returns the providers listed in the file of the given kind, or in any file if kind is empty
+func (r *RDBMSRepository) GetProvidersByPortal(ctx context.Context, portalName string, kind entity.FileKind) ([]*entity.Provider, error) {
 	var providers []*entity.Provider
 
 	execErr := r.runInTx(func(tx *sql.Tx) error {
@@ -133,9 +175,13 @@ func (r *RDBMSRepository) GetProvidersByPortal(ctx context.Context, portalName s
 		}
 
 		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
-		query, args, err := psql.Select("id", "domain_name", "account_id", "account_type", "cert_auth_id", "portal_id", "created_at").
+		where := qu.Eq{"portal_id": portalID}
+		if kind != "" {
+			where["file_kind"] = kind
+		}
+		query, args, err := psql.Select(providerColumns...).
 			From("provider").
-			Where(qu.Eq{"portal_id": portalID}).
+			Where(where).
 			ToSql()
 		rows, err := tx.QueryContext(ctx, query, args...)
 		if err != nil {
@@ -161,39 +207,152 @@ func (r *RDBMSRepository) AddProvider(ctx context.Context, provider *entity.Prov
 	var id int
 
 	execErr := r.runInTx(func(tx *sql.Tx) error {
-		// Insert
 		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
-		query, args, err := psql.Insert("provider").Columns("domain_name", "account_id", "account_type", "cert_auth_id", "portal_id", "created_at", "updated_at").
-			Values(provider.DomainName, provider.AccountID, provider.AccountType, provider.CertAuthID, provider.PortalID, provider.CreatedAt, provider.CreatedAt).
+		query, args, err := psql.Insert("provider").Columns("domain_name", "account_id", "account_type", "cert_auth_id", "portal_id", "raw_line", "file_kind", "created_at", "updated_at").
+			Values(provider.DomainName, provider.AccountID, provider.AccountType, provider.CertAuthID, provider.PortalID, nullString(provider.RawLine), fileKindOrDefault(provider.FileKind), provider.CreatedAt, provider.CreatedAt).
+			Suffix("RETURNING id").
 			ToSql()
 		if err != nil {
 			return err
 		}
-		if _, err = tx.ExecContext(ctx, query, args...); err != nil {
-			return err
-		}
-
-		// Get last insertedID
 		var id0 int
-		selectMax := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
-			Select("MAX(id)").
-			From("provider")
-		queryRows, args, err := selectMax.ToSql()
-		if err := tx.QueryRowContext(ctx, queryRows, args...).Scan(&id0); err != nil {
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&id0); err != nil {
 			return err
 		}
 
 		id = id0
 		return nil
 
-	}, sql.LevelSerializable)
+	}, sql.LevelReadCommitted)
 
 	if execErr != nil {
 		return 0, execErr
 	}
+	provider.ID = id
 	return id, nil
 }
 
+// providersBatchSize keeps the multi-row inserts well below the limit of query parameters
+const providersBatchSize = 1000
+
+// ReplaceProviders atomically replaces the providers of the portal listed in the file of the given kind,
+// so that readers never see a partial list. It returns the number of inserted providers.
+func (r *RDBMSRepository) ReplaceProviders(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider) (int, error) {
+	var n int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		n0, err := replaceProviders(ctx, tx, portalID, kind, providers)
+		if err != nil {
+			return err
+		}
+
+		n = n0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return 0, execErr
+	}
+	return n, nil
+}
+
+// ReplaceProvidersAndVariables replaces the providers and the variables of the portal listed in the file
+// of the given kind at once, so that they never get out of sync. It returns the number of inserted providers.
+func (r *RDBMSRepository) ReplaceProvidersAndVariables(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider, vars []*entity.Variable) (int, error) {
+	var n int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		n0, err := replaceProviders(ctx, tx, portalID, kind, providers)
+		if err != nil {
+			return err
+		}
+		if err := replacePortalVariables(ctx, tx, portalID, kind, vars); err != nil {
+			return err
+		}
+
+		n = n0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return 0, execErr
+	}
+	return n, nil
+}
+
+func replaceProviders(ctx context.Context, tx *sql.Tx, portalID int, kind entity.FileKind, providers []*entity.Provider) (int, error) {
+	kind = fileKindOrDefault(kind)
+	psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+
+	// Lock the portal, serializing concurrent replaces of its providers
+	var id int
+	lockQuery, args, err := psql.Select("id").
+		From("portal").
+		Where(qu.Eq{"id": portalID}).
+		Suffix("FOR UPDATE").
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRowContext(ctx, lockQuery, args...).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, errors.Errorf("portal with id '%v' not found", portalID)
+		}
+		return 0, err
+	}
+
+	deleteQuery, args, err := psql.Delete("provider").
+		Where(qu.Eq{"portal_id": portalID, "file_kind": kind}).
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tx.ExecContext(ctx, deleteQuery, args...); err != nil {
+		return 0, err
+	}
+
+	var n0 int64
+	for start := 0; start < len(providers); start += providersBatchSize {
+		end := start + providersBatchSize
+		if end > len(providers) {
+			end = len(providers)
+		}
+		insert := psql.Insert("provider").Columns("domain_name", "account_id", "account_type", "cert_auth_id", "portal_id", "raw_line", "file_kind", "created_at", "updated_at")
+		for _, p := range providers[start:end] {
+			insert = insert.Values(p.DomainName, p.AccountID, p.AccountType, p.CertAuthID, portalID, nullString(p.RawLine), kind, p.CreatedAt, p.CreatedAt)
+		}
+		query, args, err := insert.Suffix("ON CONFLICT DO NOTHING").ToSql()
+		if err != nil {
+			return 0, err
+		}
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		n0 += inserted
+	}
+
+	// Verify the new providers against the sellers known already
+	query, args, err := psql.Update("provider").
+		Set("verification", qu.Expr(verificationExpr)).
+		Where(qu.Eq{"portal_id": portalID, "file_kind": kind}).
+		ToSql()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return 0, err
+	}
+
+	return int(n0), nil
+}
+
 func (r *RDBMSRepository) DeleteProvider(ctx context.Context, portalName string) error {
 	return r.runInTx(func(tx *sql.Tx) error {
 		var portalID int
@@ -221,6 +380,17 @@ func (r *RDBMSRepository) DeleteProvider(ctx context.Context, portalName string)
 			return err
 		}
 
+		// Forget the state of the last fetches, so that the next crawl stores the providers again
+		deleteQuery, args, err = deleteSql.Delete("portal_file").
+			Where(qu.Eq{"portal_id": portalID}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, deleteQuery, args...); err != nil {
+			return err
+		}
+
 		return nil
 
 	}, sql.LevelSerializable)
@@ -231,7 +401,8 @@ func scanPortalRows(rows *sql.Rows, limit uint64) ([]*entity.Portal, error) {
 	defer rows.Close()
 	for rows.Next() {
 		e := &entity.Portal{}
-		if err := rows.Scan(&e.ID, &e.Protocol, &e.CanonicalName, &e.Email, &e.Phone, &e.CertInfo, &e.CreatedAt); err != nil {
+		if err := rows.Scan(&e.ID, &e.Protocol, &e.CanonicalName, &e.Email, &e.Phone, &e.CertInfo, &e.CrawlInterval, &e.NextCrawlAt, &e.CreatedAt, &e.FileKind,
+			&e.ParentID, &e.Fallbacks, &e.Parent, pq.Array(&e.Subdomains)); err != nil {
 			return nil, err
 		}
 		portals = append(portals, e)
@@ -239,12 +410,31 @@ func scanPortalRows(rows *sql.Rows, limit uint64) ([]*entity.Portal, error) {
 	return portals, nil
 }
 
+// providerColumns are scanned by scanProviderRows, providers stored before raw lines were kept have an empty one
+var providerColumns = []string{"id", "domain_name", "account_id", "account_type", "cert_auth_id", "portal_id", "COALESCE(raw_line, '')", "file_kind", "verification", "created_at"}
+
+// fileKindOrDefault takes the providers and variables of an unspecified file for the ones of ads.txt
+func fileKindOrDefault(kind entity.FileKind) entity.FileKind {
+	if kind == "" {
+		return entity.FileKindAds
+	}
+	return kind
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
 func scanProviderRows(rows *sql.Rows, limit uint64) ([]*entity.Provider, error) {
 	providers := make([]*entity.Provider, 0, limit)
 	defer rows.Close()
 	for rows.Next() {
 		e := &entity.Provider{}
-		if err := rows.Scan(&e.ID, &e.DomainName, &e.AccountID, &e.AccountType, &e.CertAuthID, &e.PortalID, &e.CreatedAt); err != nil {
+		if err := rows.Scan(&e.ID, &e.DomainName, &e.AccountID, &e.AccountType, &e.CertAuthID, &e.PortalID, &e.RawLine, &e.FileKind, &e.Verification, &e.CreatedAt); err != nil {
 			return nil, err
 		}
 		providers = append(providers, e)
@@ -263,7 +453,26 @@ func (r *RDBMSRepository) Init() error {
 
 type dbExecutor func(tx *sql.Tx) error
 
+const (
+	maxTxAttempts = 5
+	txRetryDelay  = 20 * time.Millisecond
+)
+
+// runInTx executes the executor in a transaction. Transactions failed on a serialization failure
+// or a deadlock are retried, so executors must not keep state between their runs.
 func (r *RDBMSRepository) runInTx(executor dbExecutor, isoLevel sql.IsolationLevel) error {
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = r.runInTxOnce(executor, isoLevel)
+		if !isRetryable(err) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * txRetryDelay)
+	}
+	return errors.Wrapf(err, "giving up after %v attempts", maxTxAttempts)
+}
+
+func (r *RDBMSRepository) runInTxOnce(executor dbExecutor, isoLevel sql.IsolationLevel) error {
 	tx, err := r.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: isoLevel})
 	if err != nil {
 		return err
@@ -279,6 +488,20 @@ func (r *RDBMSRepository) runInTx(executor dbExecutor, isoLevel sql.IsolationLev
 	return tx.Commit()
 }
 
+const (
+	pqSerializationFailure = "40001"
+	pqDeadlockDetected     = "40P01"
+	pqUniqueViolation      = "23505"
+)
+
+func isRetryable(err error) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	if !ok {
+		return false
+	}
+	return pqErr.Code == pqSerializationFailure || pqErr.Code == pqDeadlockDetected
+}
+
 func (r *RDBMSRepository) MigrateUp() error {
 	_, err := migrate.Exec(r.db, r.Cfg.Driver, migrations, migrate.Up)
 	return err
@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isRetryable(&pq.Error{Code: pqSerializationFailure}))
+	assert.True(t, isRetryable(errors.Wrap(&pq.Error{Code: pqDeadlockDetected}, "rollback failed")))
+	assert.False(t, isRetryable(&pq.Error{Code: pqUniqueViolation}))
+	assert.False(t, isRetryable(errors.New("some error")))
+	assert.False(t, isRetryable(nil))
+}
+
+func TestAddProviderConcurrently(t *testing.T) {
+	t.Parallel()
+
+	repo, closer, repoErr := NewDockerRepo()
+	defer closer()
+	require.NoError(t, repoErr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const n = 50
+	testPortalID := 1
+	ids := make([]int, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = repo.AddProvider(ctx, &entity.Provider{
+				DomainName:  "google.com",
+				AccountID:   fmt.Sprintf("pub-%v", i),
+				AccountType: "direct",
+				PortalID:    testPortalID,
+				CreatedAt:   time.Now().UTC(),
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, errs[i])
+	}
+
+	// Every returned ID points to the row inserted by its own call
+	stored, err := repo.GetProvidersByPortal(ctx, "cnn.com", "")
+	require.NoError(t, err)
+	require.Len(t, stored, n)
+	accountByID := map[int]string{}
+	for _, p := range stored {
+		accountByID[p.ID] = p.AccountID
+	}
+	for i, id := range ids {
+		assert.Equal(t, fmt.Sprintf("pub-%v", i), accountByID[id], "id %v", id)
+	}
+}
+
+func TestAddCrawlJobInBatches(t *testing.T) {
+	t.Parallel()
+
+	repo, closer, repoErr := NewDockerRepo()
+	defer closer()
+	require.NoError(t, repoErr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// More parameters than a single statement may carry
+	n := 2*crawlResultsBatchSize + 1
+	crawlResults := func(from int) []*entity.CrawlResult {
+		var results []*entity.CrawlResult
+		for i := from; i < from+n; i++ {
+			results = append(results, &entity.CrawlResult{PortalID: i, PortalName: fmt.Sprintf("portal%v.com", i), State: entity.JobQueued})
+		}
+		return results
+	}
+	job := &entity.CrawlJob{State: entity.JobQueued, PortalsTotal: n, CreatedAt: time.Now().UTC(), Results: crawlResults(1)}
+	id, err := repo.AddCrawlJob(ctx, job)
+	require.NoError(t, err)
+
+	more := crawlResults(n + 1)
+	for _, res := range more {
+		res.JobID = id
+	}
+	require.NoError(t, repo.AddCrawlResults(ctx, more))
+
+	stored, err := repo.GetCrawlJob(ctx, id)
+	require.NoError(t, err)
+	assert.Len(t, stored.Results, 2*n)
+}
+
+func TestVerifyProviders(t *testing.T) {
+	t.Parallel()
+
+	repo, closer, repoErr := NewDockerRepo()
+	defer closer()
+	require.NoError(t, repoErr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	testPortalID := 2
+	adSystem := "verify-test.com"
+	_, err := repo.ReplaceSellers(ctx, adSystem, []*entity.Seller{
+		{SellerID: "publisher", SellerType: entity.SellerPublisher},
+		{SellerID: "intermediary", SellerType: entity.SellerIntermediary},
+		{SellerID: "both", SellerType: entity.SellerBoth},
+	})
+	require.NoError(t, err)
+
+	// Providers stored after the sellers are verified as well
+	var providers []*entity.Provider
+	for _, sellerID := range []string{"publisher", "intermediary", "both", "unlisted"} {
+		for _, rel := range []string{entity.RelationshipDirect, entity.RelationshipReseller} {
+			providers = append(providers, &entity.Provider{DomainName: adSystem, AccountID: sellerID, AccountType: rel, PortalID: testPortalID, CreatedAt: time.Now().UTC()})
+		}
+	}
+	_, err = repo.ReplaceProviders(ctx, testPortalID, entity.FileKindAds, providers)
+	require.NoError(t, err)
+
+	verified := func() map[string]string {
+		stored, err := repo.GetProvidersByPortal(ctx, "gizmodo.com", entity.FileKindAds)
+		require.NoError(t, err)
+		verification := map[string]string{}
+		for _, p := range stored {
+			verification[p.AccountID+"/"+p.AccountType] = p.Verification
+		}
+		return verification
+	}
+	assert.Equal(t, map[string]string{
+		"publisher/direct":      entity.VerificationVerified,
+		"publisher/reseller":    entity.VerificationTypeMismatch,
+		"intermediary/direct":   entity.VerificationTypeMismatch,
+		"intermediary/reseller": entity.VerificationVerified,
+		"both/direct":           entity.VerificationVerified,
+		"both/reseller":         entity.VerificationVerified,
+		"unlisted/direct":       entity.VerificationUnknown,
+		"unlisted/reseller":     entity.VerificationUnknown,
+	}, verified())
+
+	// Replacing the sellers re-verifies the providers
+	_, err = repo.ReplaceSellers(ctx, adSystem, []*entity.Seller{{SellerID: "unlisted", SellerType: entity.SellerPublisher}})
+	require.NoError(t, err)
+	verification := verified()
+	assert.Equal(t, entity.VerificationUnknown, verification["publisher/direct"])
+	assert.Equal(t, entity.VerificationVerified, verification["unlisted/direct"])
+	assert.Equal(t, entity.VerificationTypeMismatch, verification["unlisted/reseller"])
+}
@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	qu "github.com/Masterminds/squirrel"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// GetDuePortals returns the portals which were never crawled by the scheduler or are due till the given time
+func (r *RDBMSRepository) GetDuePortals(ctx context.Context, till time.Time) ([]*entity.Portal, error) {
+	var portals []*entity.Portal
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		selectPortals := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select(portalColumns...).
+			From("portal").
+			Where(qu.Or{qu.Eq{"next_crawl_at": nil}, qu.LtOrEq{"next_crawl_at": till}}).
+			OrderBy("next_crawl_at ASC NULLS FIRST")
+		query, args, err := selectPortals.ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		portals0, err := scanPortalRows(rows, 0)
+		if err != nil {
+			return err
+		}
+		portals = portals0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return portals, nil
+}
+
+// SetNextCrawls stores the next scheduled crawl time per portal ID
+func (r *RDBMSRepository) SetNextCrawls(ctx context.Context, next map[int]time.Time) error {
+	return r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		for portalID, at := range next {
+			query, args, err := psql.Update("portal").
+				Set("next_crawl_at", at).
+				Where(qu.Eq{"id": portalID}).
+				ToSql()
+			if err != nil {
+				return err
+			}
+			if _, err = tx.ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	}, sql.LevelReadCommitted)
+}
+
+// SetPortalProtocol stores the protocol of the portal along with the number of consecutive crawls
+// which only succeeded over the other protocol
+func (r *RDBMSRepository) SetPortalProtocol(ctx context.Context, portalID int, protocol string, fallbacks int) error {
+	return r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Update("portal").
+			Set("protocol", protocol).
+			Set("protocol_fallbacks", fallbacks).
+			Where(qu.Eq{"id": portalID}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, query, args...)
+		return err
+
+	}, sql.LevelReadCommitted)
+}
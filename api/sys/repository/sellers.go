@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	qu "github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// sellersBatchSize keeps the multi-row inserts well below the limit of query parameters
+const sellersBatchSize = 1000
+
+// verificationExpr computes the verification of the provider row being updated against the sellers.json of its
+// advertising system: the seller type must match the relationship, 'BOTH' matching either of them
+var verificationExpr = fmt.Sprintf(`COALESCE((SELECT CASE
+		WHEN s.seller_type = '%v'
+			OR (provider.account_type = '%v' AND s.seller_type = '%v')
+			OR (provider.account_type = '%v' AND s.seller_type = '%v') THEN '%v'
+		ELSE '%v' END
+	FROM seller s WHERE s.ad_system = provider.domain_name AND s.seller_id = provider.account_id), '%v')`,
+	entity.SellerBoth,
+	entity.RelationshipDirect, entity.SellerPublisher,
+	entity.RelationshipReseller, entity.SellerIntermediary, entity.VerificationVerified,
+	entity.VerificationTypeMismatch, entity.VerificationUnknown)
+
+// GetProviderDomains returns the distinct domains of the advertising systems listed by the portals
+func (r *RDBMSRepository) GetProviderDomains(ctx context.Context) ([]string, error) {
+	var domains []string
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select("DISTINCT domain_name").
+			From("provider").
+			OrderBy("domain_name").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var domains0 []string
+		for rows.Next() {
+			var d string
+			if err := rows.Scan(&d); err != nil {
+				return err
+			}
+			domains0 = append(domains0, d)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		domains = domains0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return domains, nil
+}
+
+// ReplaceSellers atomically replaces the sellers of the advertising system and re-verifies the providers listing it.
+// It returns the number of stored sellers.
+func (r *RDBMSRepository) ReplaceSellers(ctx context.Context, adSystem string, sellers []*entity.Seller) (int, error) {
+	var n int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		deleteQuery, args, err := psql.Delete("seller").
+			Where(qu.Eq{"ad_system": adSystem}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, deleteQuery, args...); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		var n0 int64
+		for start := 0; start < len(sellers); start += sellersBatchSize {
+			end := start + sellersBatchSize
+			if end > len(sellers) {
+				end = len(sellers)
+			}
+			insert := psql.Insert("seller").Columns("ad_system", "seller_id", "seller_type", "name", "domain", "is_confidential", "created_at")
+			for _, s := range sellers[start:end] {
+				insert = insert.Values(adSystem, s.SellerID, s.SellerType, s.Name, s.Domain, s.IsConfidential, now)
+			}
+			// A seller listed twice is stored once
+			query, args, err := insert.Suffix("ON CONFLICT DO NOTHING").ToSql()
+			if err != nil {
+				return err
+			}
+			res, err := tx.ExecContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			inserted, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			n0 += inserted
+		}
+
+		query, args, err := psql.Update("provider").
+			Set("verification", qu.Expr(verificationExpr)).
+			Where(qu.Eq{"domain_name": adSystem}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return errors.Wrap(err, "failed to verify the providers")
+		}
+
+		n = int(n0)
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return 0, execErr
+	}
+	return n, nil
+}
+
+// GetSellerMismatches returns the providers of the portal whose relationship does not match the type of their seller
+func (r *RDBMSRepository) GetSellerMismatches(ctx context.Context, portalName string) ([]*entity.SellerMismatch, error) {
+	var mismatches []*entity.SellerMismatch
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select("provider.id", "provider.domain_name", "provider.account_id", "provider.account_type", "provider.cert_auth_id",
+				"provider.portal_id", "COALESCE(provider.raw_line, '')", "provider.file_kind", "provider.verification", "provider.created_at",
+				"s.seller_type", "s.name").
+			From("provider").
+			Join("portal p ON p.id = provider.portal_id").
+			Join("seller s ON s.ad_system = provider.domain_name AND s.seller_id = provider.account_id").
+			Where(qu.Eq{"p.canonical_name": portalName, "provider.verification": entity.VerificationTypeMismatch}).
+			OrderBy("provider.domain_name", "provider.account_id").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		mismatches0 := []*entity.SellerMismatch{}
+		for rows.Next() {
+			e := &entity.Provider{}
+			m := &entity.SellerMismatch{Provider: e}
+			if err := rows.Scan(&e.ID, &e.DomainName, &e.AccountID, &e.AccountType, &e.CertAuthID, &e.PortalID, &e.RawLine, &e.FileKind, &e.Verification, &e.CreatedAt,
+				&m.SellerType, &m.SellerName); err != nil {
+				return err
+			}
+			mismatches0 = append(mismatches0, m)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		mismatches = mismatches0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,216 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	qu "github.com/Masterminds/squirrel"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// AddSnapshot stores the snapshot unless the latest snapshot of the file has the same hash. It reports whether it was stored.
+func (r *RDBMSRepository) AddSnapshot(ctx context.Context, snap *entity.Snapshot) (bool, error) {
+	var id int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+		kind := fileKindOrDefault(snap.FileKind)
+		query, args, err := psql.Select("sha256").
+			From("snapshot").
+			Where(qu.Eq{"portal_id": snap.PortalID, "file_kind": kind}).
+			OrderBy("fetched_at DESC", "id DESC").
+			Limit(1).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		var latest string
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&latest)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if latest == snap.SHA256 {
+			id = 0
+			return nil
+		}
+
+		query, args, err = psql.Insert("snapshot").
+			Columns("portal_id", "file_kind", "fetched_at", "sha256", "providers", "content", "diagnostics").
+			Values(snap.PortalID, kind, snap.FetchedAt, snap.SHA256, snap.Providers, snap.Content, snap.Diagnostics).
+			Suffix("RETURNING id").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		var id0 int
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&id0); err != nil {
+			return err
+		}
+
+		id = id0
+		return nil
+
+	}, sql.LevelSerializable)
+
+	if execErr != nil {
+		return false, execErr
+	}
+	if id == 0 {
+		return false, nil
+	}
+	snap.ID = id
+	return true, nil
+}
+
+// ListSnapshots returns the snapshots of the portal without their content, the latest first
+func (r *RDBMSRepository) ListSnapshots(ctx context.Context, portalName string) ([]*entity.Snapshot, error) {
+	var snaps []*entity.Snapshot
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select("s.id", "s.portal_id", "s.file_kind", "s.fetched_at", "s.sha256", "s.providers").
+			From("snapshot s").
+			Join("portal p ON p.id = s.portal_id").
+			Where(qu.Eq{"p.canonical_name": portalName}).
+			OrderBy("s.fetched_at DESC", "s.id DESC").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		snaps0 := []*entity.Snapshot{}
+		for rows.Next() {
+			s := &entity.Snapshot{}
+			if err := rows.Scan(&s.ID, &s.PortalID, &s.FileKind, &s.FetchedAt, &s.SHA256, &s.Providers); err != nil {
+				return err
+			}
+			snaps0 = append(snaps0, s)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		snaps = snaps0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return snaps, nil
+}
+
+// GetSnapshot returns a snapshot of the portal with its content, or entity.ErrNotFound
+func (r *RDBMSRepository) GetSnapshot(ctx context.Context, portalName string, id int) (*entity.Snapshot, error) {
+	var snap *entity.Snapshot
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select("s.id", "s.portal_id", "s.file_kind", "s.fetched_at", "s.sha256", "s.providers", "s.content", "s.diagnostics").
+			From("snapshot s").
+			Join("portal p ON p.id = s.portal_id").
+			Where(qu.Eq{"p.canonical_name": portalName, "s.id": id}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		s := &entity.Snapshot{}
+		err = tx.QueryRowContext(ctx, query, args...).
+			Scan(&s.ID, &s.PortalID, &s.FileKind, &s.FetchedAt, &s.SHA256, &s.Providers, &s.Content, &s.Diagnostics)
+		if err == sql.ErrNoRows {
+			return entity.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		snap = s
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return snap, nil
+}
+
+// GetSnapshotAt returns the latest snapshot of the file of the portal fetched till the given time, or entity.ErrNotFound
+func (r *RDBMSRepository) GetSnapshotAt(ctx context.Context, portalName string, kind entity.FileKind, at time.Time) (*entity.Snapshot, error) {
+	var snap *entity.Snapshot
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select("s.id", "s.portal_id", "s.file_kind", "s.fetched_at", "s.sha256", "s.providers", "s.content", "s.diagnostics").
+			From("snapshot s").
+			Join("portal p ON p.id = s.portal_id").
+			Where(qu.Eq{"p.canonical_name": portalName, "s.file_kind": fileKindOrDefault(kind)}).
+			Where(qu.LtOrEq{"s.fetched_at": at}).
+			OrderBy("s.fetched_at DESC", "s.id DESC").
+			Limit(1).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		s := &entity.Snapshot{}
+		err = tx.QueryRowContext(ctx, query, args...).
+			Scan(&s.ID, &s.PortalID, &s.FileKind, &s.FetchedAt, &s.SHA256, &s.Providers, &s.Content, &s.Diagnostics)
+		if err == sql.ErrNoRows {
+			return entity.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		snap = s
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return snap, nil
+}
+
+// PruneSnapshots deletes the snapshots fetched before the given time, always keeping the latest snapshot of every file.
+// It returns the number of deleted snapshots.
+func (r *RDBMSRepository) PruneSnapshots(ctx context.Context, before time.Time) (int, error) {
+	var n int
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Delete("snapshot").
+			Where(qu.Lt{"fetched_at": before}).
+			Where(`id NOT IN (SELECT DISTINCT ON (portal_id, file_kind) id FROM snapshot
+				ORDER BY portal_id, file_kind, fetched_at DESC, id DESC)`).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		n = int(deleted)
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return 0, execErr
+	}
+	return n, nil
+}
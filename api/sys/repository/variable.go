@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	qu "github.com/Masterminds/squirrel"
+
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+)
+
+// variablesBatchSize keeps the multi-row inserts well below the limit of query parameters
+const variablesBatchSize = 1000
+
+// ReplacePortalVariables atomically replaces the variables declared by the portal in the file of the given kind
+func (r *RDBMSRepository) ReplacePortalVariables(ctx context.Context, portalID int, kind entity.FileKind, vars []*entity.Variable) error {
+	return r.runInTx(func(tx *sql.Tx) error {
+		return replacePortalVariables(ctx, tx, portalID, kind, vars)
+	}, sql.LevelReadCommitted)
+}
+
+func replacePortalVariables(ctx context.Context, tx *sql.Tx, portalID int, kind entity.FileKind, vars []*entity.Variable) error {
+	kind = fileKindOrDefault(kind)
+	psql := qu.StatementBuilder.PlaceholderFormat(qu.Dollar)
+	deleteQuery, args, err := psql.Delete("portal_variable").
+		Where(qu.Eq{"portal_id": portalID, "file_kind": kind}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, deleteQuery, args...); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for start := 0; start < len(vars); start += variablesBatchSize {
+		end := start + variablesBatchSize
+		if end > len(vars) {
+			end = len(vars)
+		}
+		insert := psql.Insert("portal_variable").Columns("portal_id", "name", "value", "line", "file_kind", "created_at")
+		for _, v := range vars[start:end] {
+			insert = insert.Values(portalID, v.Name, v.Value, v.Line, kind, now)
+		}
+		query, args, err := insert.ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPortalVariables returns the ads.txt variables of the portal in the order they are declared
+func (r *RDBMSRepository) GetPortalVariables(ctx context.Context, portalName string) ([]*entity.Variable, error) {
+	var vars []*entity.Variable
+
+	execErr := r.runInTx(func(tx *sql.Tx) error {
+		query, args, err := qu.StatementBuilder.PlaceholderFormat(qu.Dollar).
+			Select("v.id", "v.portal_id", "v.name", "v.value", "v.line", "v.file_kind", "v.created_at").
+			From("portal_variable v").
+			Join("portal p ON p.id = v.portal_id").
+			Where(qu.Eq{"p.canonical_name": portalName}).
+			OrderBy("v.file_kind", "v.line", "v.id").
+			ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		vars0 := []*entity.Variable{}
+		for rows.Next() {
+			v := &entity.Variable{}
+			if err := rows.Scan(&v.ID, &v.PortalID, &v.Name, &v.Value, &v.Line, &v.FileKind, &v.CreatedAt); err != nil {
+				return err
+			}
+			vars0 = append(vars0, v)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		vars = vars0
+		return nil
+
+	}, sql.LevelReadCommitted)
+
+	if execErr != nil {
+		return nil, execErr
+	}
+	return vars, nil
+}
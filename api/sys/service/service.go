@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"github.com/nettyrnp/ads-crawler/api/common"
 	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+	"github.com/nettyrnp/ads-crawler/api/sys/importer"
 	"github.com/nettyrnp/ads-crawler/api/sys/repository"
 	"github.com/nettyrnp/ads-crawler/config"
 	"github.com/pkg/errors"
+	"io"
+	"sort"
 	"time"
 )
 
@@ -19,10 +22,42 @@ var (
 type Service interface {
 	GetPortals(ctx context.Context) ([]*entity.Portal, error)
 	GetPortalsExt(ctx context.Context, from time.Time, till time.Time, sortBy entity.PortalSortField, sortDesc bool, limit uint64, offset uint64) ([]*entity.Portal, int, error)
+	GetPortal(ctx context.Context, name string) (*entity.Portal, error)
+	AddPortal(ctx context.Context, portal *entity.Portal) (int, error)
+	UpdatePortal(ctx context.Context, name string, portal *entity.Portal) error
+	DeletePortal(ctx context.Context, name string) error
+	ImportPortals(ctx context.Context, r io.Reader, format importer.Format) (*entity.ImportReport, error)
 	AddProvider(ctx context.Context, provider *entity.Provider) (int, error)
 	DeleteProvider(ctx context.Context, portalID string) error
-	GetProvidersByPortal(ctx context.Context, portalName string) ([]*entity.Provider, error)
+	ReplaceProviders(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider) (int, error)
+	GetProvidersByPortal(ctx context.Context, portalName string, kind entity.FileKind) ([]*entity.Provider, error)
+	GetPortalsWithoutRawLines(ctx context.Context) ([]*entity.Portal, error)
+	ReplacePortalVariables(ctx context.Context, portalID int, kind entity.FileKind, vars []*entity.Variable) error
+	ReplaceProvidersAndVariables(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider, vars []*entity.Variable) (int, error)
+	GetPortalVariables(ctx context.Context, portalName string) ([]*entity.Variable, error)
+	AddSubdomainPortals(ctx context.Context, parent *entity.Portal, names []string) ([]*entity.Portal, error)
+	AddCrawlResults(ctx context.Context, job *entity.CrawlJob, portals []*entity.Portal) error
+	GetProviderDomains(ctx context.Context) ([]string, error)
+	ReplaceSellers(ctx context.Context, adSystem string, sellers []*entity.Seller) (int, error)
+	GetSellerMismatches(ctx context.Context, portalName string) ([]*entity.SellerMismatch, error)
 	NotifyPortalAdmins(ctx context.Context, portal *entity.Portal) error
+	AddCrawlJob(ctx context.Context, portals []*entity.Portal) (*entity.CrawlJob, error)
+	UpdateCrawlJob(ctx context.Context, job *entity.CrawlJob) error
+	UpdateCrawlResult(ctx context.Context, res *entity.CrawlResult) error
+	TouchCrawlJob(ctx context.Context, id int) error
+	GetCrawlJob(ctx context.Context, id int) (*entity.CrawlJob, error)
+	FailUnfinishedCrawlJobs(ctx context.Context) (int, error)
+	GetDuePortals(ctx context.Context, till time.Time) ([]*entity.Portal, error)
+	SetNextCrawls(ctx context.Context, next map[int]time.Time) error
+	SetPortalProtocol(ctx context.Context, portalID int, protocol string, fallbacks int) error
+	GetPortalFile(ctx context.Context, portalID int, kind entity.FileKind) (*entity.PortalFile, error)
+	SavePortalFile(ctx context.Context, file *entity.PortalFile) error
+	AddSnapshot(ctx context.Context, snap *entity.Snapshot) (bool, error)
+	ListSnapshots(ctx context.Context, portalName string) ([]*entity.Snapshot, error)
+	GetSnapshot(ctx context.Context, portalName string, id int) (*entity.Snapshot, error)
+	GetPortalCrawls(ctx context.Context, portalName string, limit, offset uint64) ([]*entity.CrawlResult, int, error)
+	DiffProviders(ctx context.Context, portalName string, kind entity.FileKind, from, to entity.SnapshotRef) (*entity.ProviderDiff, error)
+	PruneSnapshots(ctx context.Context, before time.Time) (int, error)
 }
 
 type emailNotifier interface {
@@ -67,6 +102,80 @@ func (s *AdsService) GetPortalsExt(ctx context.Context, from time.Time, till tim
 	return s.Repo.GetPortalsExt(ctx, opts)
 }
 
+func (s *AdsService) GetPortal(ctx context.Context, name string) (*entity.Portal, error) {
+	return s.Repo.GetPortal(ctx, name)
+}
+
+func (s *AdsService) AddPortal(ctx context.Context, portal *entity.Portal) (int, error) {
+	portal.Normalize()
+	if err := portal.Validate(); err != nil {
+		return 0, err
+	}
+	return s.Repo.AddPortal(ctx, portal)
+}
+
+func (s *AdsService) UpdatePortal(ctx context.Context, name string, portal *entity.Portal) error {
+	portal.Normalize()
+	if err := portal.Validate(); err != nil {
+		return err
+	}
+	return s.Repo.UpdatePortal(ctx, name, portal)
+}
+
+func (s *AdsService) DeletePortal(ctx context.Context, name string) error {
+	return s.Repo.DeletePortal(ctx, name)
+}
+
+// ImportPortals upserts the portals of a CSV or JSON lines list, rejecting invalid and duplicate rows
+func (s *AdsService) ImportPortals(ctx context.Context, r io.Reader, format importer.Format) (*entity.ImportReport, error) {
+	rows, rejected, err := importer.Read(r, format)
+	if err != nil {
+		return nil, err
+	}
+	report := &entity.ImportReport{
+		Total:    len(rows) + len(rejected),
+		Rejected: rejected,
+	}
+
+	var portals []*entity.Portal
+	seen := map[string]int{}
+	for _, row := range rows {
+		kind := row.Portal.FileKind
+		row.Portal.Normalize()
+		// A portal without a protocol or file kind is inserted with the defaults, a stored one keeps its own
+		if kind == "" {
+			row.Portal.FileKind = ""
+		}
+		validated := *row.Portal
+		if validated.Protocol == "" {
+			validated.Protocol = entity.ProtocolHTTP
+		}
+		if err := validated.Validate(); err != nil {
+			report.Rejected = append(report.Rejected, entity.ImportRejection{Line: row.Line, Domain: row.Domain, Reason: err.Error()})
+			continue
+		}
+		if line, ok := seen[row.Portal.CanonicalName]; ok {
+			reason := fmt.Sprintf("duplicate of line %v", line)
+			report.Rejected = append(report.Rejected, entity.ImportRejection{Line: row.Line, Domain: row.Domain, Reason: reason})
+			continue
+		}
+		seen[row.Portal.CanonicalName] = row.Line
+		portals = append(portals, row.Portal)
+	}
+	sort.SliceStable(report.Rejected, func(i, j int) bool {
+		return report.Rejected[i].Line < report.Rejected[j].Line
+	})
+
+	inserted, updated, err := s.Repo.UpsertPortals(ctx, portals)
+	report.Inserted = inserted
+	report.Updated = updated
+	if err != nil {
+		return report, errors.Wrapf(err, "import stopped after %v inserted and %v updated portals", inserted, updated)
+	}
+	report.Unchanged = len(portals) - inserted - updated
+	return report, nil
+}
+
 func (s *AdsService) AddProvider(ctx context.Context, provider *entity.Provider) (int, error) {
 	return s.Repo.AddProvider(ctx, provider)
 }
@@ -75,8 +184,54 @@ func (s *AdsService) DeleteProvider(ctx context.Context, portalID string) error
 	return s.Repo.DeleteProvider(ctx, portalID)
 }
 
-func (s *AdsService) GetProvidersByPortal(ctx context.Context, portalName string) ([]*entity.Provider, error) {
-	return s.Repo.GetProvidersByPortal(ctx, portalName)
+func (s *AdsService) ReplaceProviders(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider) (int, error) {
+	return s.Repo.ReplaceProviders(ctx, portalID, kind, providers)
+}
+
+// GetProvidersByPortal returns the providers of the portal listed in the file of the given kind, or in any file if kind is empty
+func (s *AdsService) GetProvidersByPortal(ctx context.Context, portalName string, kind entity.FileKind) ([]*entity.Provider, error) {
+	return s.Repo.GetProvidersByPortal(ctx, portalName, kind)
+}
+
+func (s *AdsService) GetPortalsWithoutRawLines(ctx context.Context) ([]*entity.Portal, error) {
+	return s.Repo.GetPortalsWithoutRawLines(ctx)
+}
+
+func (s *AdsService) ReplacePortalVariables(ctx context.Context, portalID int, kind entity.FileKind, vars []*entity.Variable) error {
+	return s.Repo.ReplacePortalVariables(ctx, portalID, kind, vars)
+}
+
+// ReplaceProvidersAndVariables replaces the providers and the variables of the file of the portal in one transaction
+func (s *AdsService) ReplaceProvidersAndVariables(ctx context.Context, portalID int, kind entity.FileKind, providers []*entity.Provider, vars []*entity.Variable) (int, error) {
+	return s.Repo.ReplaceProvidersAndVariables(ctx, portalID, kind, providers, vars)
+}
+
+// GetPortalVariables returns entity.ErrNotFound for an unknown portal
+func (s *AdsService) GetPortalVariables(ctx context.Context, portalName string) ([]*entity.Variable, error) {
+	if _, err := s.Repo.GetPortal(ctx, portalName); err != nil {
+		return nil, err
+	}
+	return s.Repo.GetPortalVariables(ctx, portalName)
+}
+
+func (s *AdsService) AddSubdomainPortals(ctx context.Context, parent *entity.Portal, names []string) ([]*entity.Portal, error) {
+	return s.Repo.AddSubdomainPortals(ctx, parent, names)
+}
+
+func (s *AdsService) GetProviderDomains(ctx context.Context) ([]string, error) {
+	return s.Repo.GetProviderDomains(ctx)
+}
+
+func (s *AdsService) ReplaceSellers(ctx context.Context, adSystem string, sellers []*entity.Seller) (int, error) {
+	return s.Repo.ReplaceSellers(ctx, adSystem, sellers)
+}
+
+// GetSellerMismatches returns entity.ErrNotFound for an unknown portal
+func (s *AdsService) GetSellerMismatches(ctx context.Context, portalName string) ([]*entity.SellerMismatch, error) {
+	if _, err := s.Repo.GetPortal(ctx, portalName); err != nil {
+		return nil, err
+	}
+	return s.Repo.GetSellerMismatches(ctx, portalName)
 }
 
 func (s *AdsService) NotifyPortalAdmins(ctx context.Context, portal *entity.Portal) error {
@@ -99,3 +254,175 @@ func (s *AdsService) NotifyPortalAdmins(ctx context.Context, portal *entity.Port
 	}
 	return nil
 }
+
+func (s *AdsService) AddCrawlJob(ctx context.Context, portals []*entity.Portal) (*entity.CrawlJob, error) {
+	job := &entity.CrawlJob{
+		State:        entity.JobQueued,
+		PortalsTotal: len(portals),
+		CreatedAt:    time.Now().UTC(),
+	}
+	for _, portal := range portals {
+		job.Results = append(job.Results, &entity.CrawlResult{
+			PortalID:   portal.ID,
+			PortalName: portal.CanonicalName,
+			State:      entity.JobQueued,
+		})
+	}
+	if _, err := s.Repo.AddCrawlJob(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// AddCrawlResults adds the portals to the queue of an unfinished job
+func (s *AdsService) AddCrawlResults(ctx context.Context, job *entity.CrawlJob, portals []*entity.Portal) error {
+	var results []*entity.CrawlResult
+	for _, portal := range portals {
+		results = append(results, &entity.CrawlResult{
+			JobID:      job.ID,
+			PortalID:   portal.ID,
+			PortalName: portal.CanonicalName,
+			State:      entity.JobQueued,
+		})
+	}
+	if err := s.Repo.AddCrawlResults(ctx, results); err != nil {
+		return err
+	}
+	job.Results = append(job.Results, results...)
+	job.PortalsTotal += len(results)
+	return nil
+}
+
+func (s *AdsService) UpdateCrawlJob(ctx context.Context, job *entity.CrawlJob) error {
+	return s.Repo.UpdateCrawlJob(ctx, job)
+}
+
+func (s *AdsService) UpdateCrawlResult(ctx context.Context, res *entity.CrawlResult) error {
+	return s.Repo.UpdateCrawlResult(ctx, res)
+}
+
+func (s *AdsService) GetCrawlJob(ctx context.Context, id int) (*entity.CrawlJob, error) {
+	return s.Repo.GetCrawlJob(ctx, id)
+}
+
+func (s *AdsService) TouchCrawlJob(ctx context.Context, id int) error {
+	return s.Repo.TouchCrawlJob(ctx, id)
+}
+
+// FailUnfinishedCrawlJobs closes the jobs which were interrupted, e.g. by a restart of the service:
+// the unfinished ones without a heartbeat for CrawlJobStaleAfter
+func (s *AdsService) FailUnfinishedCrawlJobs(ctx context.Context) (int, error) {
+	staleAfter := s.Conf.CrawlJobStaleAfter
+	msg := fmt.Sprintf("interrupted, no heartbeat for %v", staleAfter)
+	return s.Repo.FailUnfinishedCrawlJobs(ctx, msg, time.Now().UTC().Add(-staleAfter))
+}
+
+func (s *AdsService) GetDuePortals(ctx context.Context, till time.Time) ([]*entity.Portal, error) {
+	return s.Repo.GetDuePortals(ctx, till)
+}
+
+func (s *AdsService) SetNextCrawls(ctx context.Context, next map[int]time.Time) error {
+	return s.Repo.SetNextCrawls(ctx, next)
+}
+
+func (s *AdsService) SetPortalProtocol(ctx context.Context, portalID int, protocol string, fallbacks int) error {
+	return s.Repo.SetPortalProtocol(ctx, portalID, protocol, fallbacks)
+}
+
+func (s *AdsService) GetPortalFile(ctx context.Context, portalID int, kind entity.FileKind) (*entity.PortalFile, error) {
+	return s.Repo.GetPortalFile(ctx, portalID, kind)
+}
+
+func (s *AdsService) SavePortalFile(ctx context.Context, file *entity.PortalFile) error {
+	return s.Repo.SavePortalFile(ctx, file)
+}
+
+func (s *AdsService) AddSnapshot(ctx context.Context, snap *entity.Snapshot) (bool, error) {
+	return s.Repo.AddSnapshot(ctx, snap)
+}
+
+// ListSnapshots returns entity.ErrNotFound for an unknown portal
+func (s *AdsService) ListSnapshots(ctx context.Context, portalName string) ([]*entity.Snapshot, error) {
+	if _, err := s.Repo.GetPortal(ctx, portalName); err != nil {
+		return nil, err
+	}
+	return s.Repo.ListSnapshots(ctx, portalName)
+}
+
+func (s *AdsService) GetSnapshot(ctx context.Context, portalName string, id int) (*entity.Snapshot, error) {
+	return s.Repo.GetSnapshot(ctx, portalName, id)
+}
+
+// DiffProviders compares the providers of the file of the portal at two crawl points. Without a kind, a snapshot referenced
+// by its ID in 'from' determines it (ads.txt otherwise). It returns entity.ErrNotFound for an unknown portal or if there is
+// no snapshot at a crawl point, and entity.ErrSnapshotMismatch for a snapshot of another portal or file kind.
+func (s *AdsService) DiffProviders(ctx context.Context, portalName string, kind entity.FileKind, from, to entity.SnapshotRef) (*entity.ProviderDiff, error) {
+	portal, err := s.Repo.GetPortal(ctx, portalName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "portal '%v'", portalName)
+	}
+	lookupKind := kind
+	if lookupKind == "" {
+		lookupKind = entity.FileKindAds
+	}
+	fromSnap, err := s.snapshotAt(ctx, portalName, lookupKind, from)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "" {
+		kind = fromSnap.FileKind
+	}
+	if err := checkSnapshot(fromSnap, portal, kind); err != nil {
+		return nil, errors.Wrap(err, "'from'")
+	}
+	toSnap, err := s.snapshotAt(ctx, portalName, kind, to)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSnapshot(toSnap, portal, kind); err != nil {
+		return nil, errors.Wrap(err, "'to'")
+	}
+
+	diff := entity.DiffProviders(entity.ParseAdsTxt([]byte(fromSnap.Content)).Providers, entity.ParseAdsTxt([]byte(toSnap.Content)).Providers)
+	fromSnap.Content, fromSnap.Diagnostics = "", nil
+	toSnap.Content, toSnap.Diagnostics = "", nil
+	diff.From, diff.To = fromSnap, toSnap
+	return diff, nil
+}
+
+// checkSnapshot rejects a snapshot of another portal or file kind than the one being compared
+func checkSnapshot(snap *entity.Snapshot, portal *entity.Portal, kind entity.FileKind) error {
+	if snap.PortalID != portal.ID {
+		return errors.Wrapf(entity.ErrSnapshotMismatch, "snapshot %v is not of portal '%v'", snap.ID, portal.CanonicalName)
+	}
+	if snap.FileKind != kind {
+		return errors.Wrapf(entity.ErrSnapshotMismatch, "snapshot %v is of %v, not %v", snap.ID, snap.FileKind, kind)
+	}
+	return nil
+}
+
+func (s *AdsService) snapshotAt(ctx context.Context, portalName string, kind entity.FileKind, ref entity.SnapshotRef) (*entity.Snapshot, error) {
+	var snap *entity.Snapshot
+	var err error
+	if ref.ID != 0 {
+		snap, err = s.Repo.GetSnapshot(ctx, portalName, ref.ID)
+	} else {
+		snap, err = s.Repo.GetSnapshotAt(ctx, portalName, kind, ref.At)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "no snapshot of portal '%v' at %v", portalName, ref)
+	}
+	return snap, nil
+}
+
+// GetPortalCrawls returns entity.ErrNotFound for an unknown portal
+func (s *AdsService) GetPortalCrawls(ctx context.Context, portalName string, limit, offset uint64) ([]*entity.CrawlResult, int, error) {
+	if _, err := s.Repo.GetPortal(ctx, portalName); err != nil {
+		return nil, 0, err
+	}
+	return s.Repo.GetPortalCrawls(ctx, portalName, limit, offset)
+}
+
+func (s *AdsService) PruneSnapshots(ctx context.Context, before time.Time) (int, error) {
+	return s.Repo.PruneSnapshots(ctx, before)
+}
@@ -2,12 +2,16 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+	"github.com/nettyrnp/ads-crawler/api/sys/importer"
 	"github.com/nettyrnp/ads-crawler/config"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 
 	"github.com/nettyrnp/ads-crawler/api/sys/repository"
@@ -43,6 +47,18 @@ func TestService(t *testing.T) {
 
 	t.Run("get portals", testGetPortals(repo))
 	t.Run("get providers by portal", testGetProvidersByPortal(repo))
+	t.Run("crawl jobs", testCrawlJobs(repo))
+	t.Run("replace providers", testReplaceProviders(repo))
+	t.Run("manage portals", testManagePortals(repo))
+	t.Run("import portals", testImportPortals(repo))
+	t.Run("raw lines", testRawLines(repo))
+	t.Run("portal variables", testPortalVariables(repo))
+	t.Run("subdomain portals", testSubdomainPortals(repo))
+	t.Run("file kinds", testFileKinds(repo))
+	t.Run("sellers", testSellers(repo))
+	t.Run("portal files", testPortalFiles(repo))
+	t.Run("snapshots", testSnapshots(repo))
+	t.Run("provider diff", testProviderDiff(repo))
 }
 
 func testGetPortals(repo *repository.RDBMSRepository) func(t *testing.T) {
@@ -64,12 +80,12 @@ func testGetProvidersByPortal(repo *repository.RDBMSRepository) func(t *testing.
 		defer cancel()
 
 		testProvName1 := "cnn.com"
-		prs, err := svc.GetProvidersByPortal(ctx, testProvName1)
+		prs, err := svc.GetProvidersByPortal(ctx, testProvName1, "")
 		require.NoError(t, err)
 		assert.Len(t, prs, 0)
 
 		testProvName2 := "nytimes.com"
-		prs, err = svc.GetProvidersByPortal(ctx, testProvName2)
+		prs, err = svc.GetProvidersByPortal(ctx, testProvName2, "")
 		require.NoError(t, err)
 		assert.Len(t, prs, 0)
 
@@ -115,13 +131,631 @@ func testGetProvidersByPortal(repo *repository.RDBMSRepository) func(t *testing.
 		require.NoError(t, err)
 		assert.Equal(t, 3, id)
 
-		prs, err = svc.GetProvidersByPortal(ctx, testProvName1)
+		prs, err = svc.GetProvidersByPortal(ctx, testProvName1, "")
 		require.NoError(t, err)
 		assert.Len(t, prs, 1)
 
-		prs, err = svc.GetProvidersByPortal(ctx, testProvName2)
+		prs, err = svc.GetProvidersByPortal(ctx, testProvName2, "")
 		require.NoError(t, err)
 		assert.Len(t, prs, 2)
 
 	}
 }
+
+func testCrawlJobs(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		portals, err := svc.GetPortals(ctx)
+		require.NoError(t, err)
+
+		job, err := svc.AddCrawlJob(ctx, portals)
+		require.NoError(t, err)
+		require.NotZero(t, job.ID)
+
+		now := time.Now().UTC()
+		job.State = entity.JobRunning
+		job.StartedAt = &now
+		job.PortalsDone = 1
+		job.Providers = 7
+		job.Unchanged = 1
+		job.Failed = 1
+		require.NoError(t, svc.UpdateCrawlJob(ctx, job))
+
+		res := job.Results[0]
+		res.State = entity.JobDone
+		res.Providers = 7
+		res.Unchanged = true
+		res.Outcome = entity.OutcomeOK
+		res.SoftNotFound = true
+		res.StatusCode = 200
+		res.DurationMs = 120
+		res.Bytes = 2048
+		res.Fetches = entity.Fetches{{File: entity.FileKindAds, URL: "https://www.cnn.com/ads.txt", Redirects: []string{"http://cnn.com/ads.txt"}}}
+		require.NoError(t, svc.UpdateCrawlResult(ctx, res))
+
+		stored, err := svc.GetCrawlJob(ctx, job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, entity.JobRunning, stored.State)
+		assert.Equal(t, len(portals), stored.PortalsTotal)
+		assert.Equal(t, 7, stored.Providers)
+		assert.Equal(t, 1, stored.Unchanged)
+		assert.Equal(t, 1, stored.Failed)
+		assert.NotNil(t, stored.StartedAt)
+		assert.Nil(t, stored.FinishedAt)
+		require.Len(t, stored.Results, len(portals))
+		for _, r := range stored.Results {
+			if r.PortalID == res.PortalID {
+				assert.Equal(t, res.Fetches, r.Fetches)
+				assert.True(t, r.Unchanged)
+				assert.Equal(t, entity.OutcomeOK, r.Outcome)
+				assert.True(t, r.SoftNotFound)
+				assert.Equal(t, 200, r.StatusCode)
+				assert.Equal(t, int64(2048), r.Bytes)
+			} else {
+				assert.Empty(t, r.Fetches)
+			}
+		}
+
+		// The job keeps beating, as if another process was running it
+		require.NoError(t, svc.TouchCrawlJob(ctx, job.ID))
+		live := New(config.Config{CrawlJobStaleAfter: time.Hour}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		n, err := live.FailUnfinishedCrawlJobs(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, n)
+		stored, err = svc.GetCrawlJob(ctx, job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, entity.JobRunning, stored.State)
+
+		time.Sleep(10 * time.Millisecond)
+		stale := New(config.Config{CrawlJobStaleAfter: 5 * time.Millisecond}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		n, err = stale.FailUnfinishedCrawlJobs(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		stored, err = svc.GetCrawlJob(ctx, job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, entity.JobFailed, stored.State)
+		assert.NotNil(t, stored.FinishedAt)
+
+		_, err = svc.GetCrawlJob(ctx, job.ID+1)
+		assert.Equal(t, entity.ErrNotFound, err)
+
+		crawls, total, err := svc.GetPortalCrawls(ctx, res.PortalName, 10, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 1, total)
+		require.Len(t, crawls, 1)
+		assert.Equal(t, job.ID, crawls[0].JobID)
+		assert.Equal(t, int64(120), crawls[0].DurationMs)
+		_, _, err = svc.GetPortalCrawls(ctx, "unknown.com", 10, 0)
+		assert.Equal(t, entity.ErrNotFound, err)
+	}
+}
+
+func testReplaceProviders(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		testPortalName := "gizmodo.com"
+		testPortalID := 2
+		now := time.Now().UTC()
+		providers := []*entity.Provider{
+			{DomainName: "google.com", AccountID: "pub-1", AccountType: "direct", PortalID: testPortalID, CreatedAt: now},
+			{DomainName: "google.com", AccountID: "pub-2", AccountType: "reseller", PortalID: testPortalID, CreatedAt: now},
+			{DomainName: "appnexus.com", AccountID: "42", AccountType: "direct", CertAuthID: "f5ab79cb980f11d1", PortalID: testPortalID, CreatedAt: now},
+		}
+		n, err := svc.ReplaceProviders(ctx, testPortalID, entity.FileKindAds, providers)
+		require.NoError(t, err)
+		assert.Equal(t, 3, n)
+
+		prs, err := svc.GetProvidersByPortal(ctx, testPortalName, "")
+		require.NoError(t, err)
+		assert.Len(t, prs, 3)
+
+		n, err = svc.ReplaceProviders(ctx, testPortalID, entity.FileKindAds, providers[:1])
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		prs, err = svc.GetProvidersByPortal(ctx, testPortalName, "")
+		require.NoError(t, err)
+		require.Len(t, prs, 1)
+		assert.Equal(t, "pub-1", prs[0].AccountID)
+
+		_, err = svc.ReplaceProviders(ctx, 12345, entity.FileKindAds, providers)
+		assert.Error(t, err)
+
+		// The same lines are stored for another portal as well
+		anotherPortalName := "wordpress.com"
+		anotherPortalID := 5
+		n, err = svc.ReplaceProviders(ctx, anotherPortalID, entity.FileKindAds, providers)
+		require.NoError(t, err)
+		assert.Equal(t, 3, n)
+
+		prs, err = svc.GetProvidersByPortal(ctx, anotherPortalName, "")
+		require.NoError(t, err)
+		assert.Len(t, prs, 3)
+		prs, err = svc.GetProvidersByPortal(ctx, testPortalName, "")
+		require.NoError(t, err)
+		assert.Len(t, prs, 1)
+	}
+}
+
+func testManagePortals(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		portal := &entity.Portal{Protocol: "https", CanonicalName: "Example.com", Email: "admin@example.com"}
+		id, err := svc.AddPortal(ctx, portal)
+		require.NoError(t, err)
+		assert.NotZero(t, id)
+		assert.Equal(t, "example.com", portal.CanonicalName)
+
+		_, err = svc.AddPortal(ctx, &entity.Portal{Protocol: "https", CanonicalName: "example.com"})
+		assert.Equal(t, entity.ErrConflict, err)
+
+		_, err = svc.AddPortal(ctx, &entity.Portal{Protocol: "gopher", CanonicalName: "example.org"})
+		assert.IsType(t, entity.ValidationErrors{}, err)
+
+		portal.Protocol = "http"
+		portal.CrawlInterval = 3600
+		require.NoError(t, svc.UpdatePortal(ctx, "example.com", portal))
+		stored, err := svc.GetPortal(ctx, "example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "http", stored.Protocol)
+		assert.Equal(t, 3600, stored.CrawlInterval)
+
+		require.NoError(t, svc.SetPortalProtocol(ctx, id, "https", 2))
+		stored, err = svc.GetPortal(ctx, "example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "https", stored.Protocol)
+		assert.Equal(t, 2, stored.Fallbacks)
+
+		_, err = svc.ReplaceProviders(ctx, id, entity.FileKindAds, []*entity.Provider{
+			{DomainName: "google.com", AccountID: "pub-1", AccountType: "direct", PortalID: id, CreatedAt: time.Now().UTC()},
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, svc.DeletePortal(ctx, "example.com"))
+		_, err = svc.GetPortal(ctx, "example.com")
+		assert.Equal(t, entity.ErrNotFound, err)
+		assert.Equal(t, entity.ErrNotFound, svc.DeletePortal(ctx, "example.com"))
+		assert.Equal(t, entity.ErrNotFound, svc.UpdatePortal(ctx, "example.com", portal))
+	}
+}
+
+func testImportPortals(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		list := "domain,protocol,email\nimport-a.com,https,admin@import-a.com\nhttp://www.Import-B.com/\nimport-a.com\nnot a domain\n"
+		report, err := svc.ImportPortals(ctx, strings.NewReader(list), importer.FormatCSV)
+		require.NoError(t, err)
+		assert.Equal(t, 4, report.Total)
+		assert.Equal(t, 2, report.Inserted)
+		require.Len(t, report.Rejected, 2)
+		assert.Equal(t, 4, report.Rejected[0].Line)
+		assert.Equal(t, "duplicate of line 2", report.Rejected[0].Reason)
+		assert.Equal(t, 5, report.Rejected[1].Line)
+
+		// Re-importing changes only the portals which differ, contacts are kept if none are given
+		list = `{"domain": "import-a.com", "protocol": "http"}` + "\n" + `{"domain": "import-b.com"}` + "\n"
+		report, err = svc.ImportPortals(ctx, strings.NewReader(list), importer.FormatJSONLines)
+		require.NoError(t, err)
+		assert.Equal(t, 0, report.Inserted)
+		assert.Equal(t, 1, report.Updated)
+		assert.Equal(t, 1, report.Unchanged)
+
+		stored, err := svc.GetPortal(ctx, "import-a.com")
+		require.NoError(t, err)
+		assert.Equal(t, "http", stored.Protocol)
+		assert.Equal(t, "admin@import-a.com", stored.Email)
+
+		// A list without protocols keeps the protocol of the stored portals, e.g. one switched by the fallback
+		require.NoError(t, svc.SetPortalProtocol(ctx, stored.ID, "https", 0))
+		report, err = svc.ImportPortals(ctx, strings.NewReader(`{"domain": "import-b.com", "fileKind": "both"}`+"\n"), importer.FormatJSONLines)
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Updated)
+		report, err = svc.ImportPortals(ctx, strings.NewReader("import-a.com\nimport-b.com\nimport-c.com\n"), importer.FormatCSV)
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Inserted)
+		assert.Equal(t, 2, report.Unchanged)
+		stored, err = svc.GetPortal(ctx, "import-a.com")
+		require.NoError(t, err)
+		assert.Equal(t, "https", stored.Protocol)
+		stored, err = svc.GetPortal(ctx, "import-b.com")
+		require.NoError(t, err)
+		assert.Equal(t, entity.FileKindBoth, stored.FileKind)
+		stored, err = svc.GetPortal(ctx, "import-c.com")
+		require.NoError(t, err)
+		assert.Equal(t, "http", stored.Protocol)
+		assert.Equal(t, entity.FileKindAds, stored.FileKind)
+	}
+}
+
+func testRawLines(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		testPortalName := "bloomberg.com"
+		testPortalID := 4
+
+		// A provider stored before raw lines were kept
+		_, err := svc.AddProvider(ctx, &entity.Provider{DomainName: "google.com", AccountID: "pub-abc", AccountType: "direct", PortalID: testPortalID, CreatedAt: time.Now().UTC()})
+		require.NoError(t, err)
+		portals, err := svc.GetPortalsWithoutRawLines(ctx)
+		require.NoError(t, err)
+		assert.Contains(t, portalNames(portals), testPortalName)
+
+		provider, err := entity.ParseProvider("google.com, pub-ABC, DIRECT, F08C47FEC0942FA0")
+		require.NoError(t, err)
+		provider.PortalID = testPortalID
+		provider.CreatedAt = time.Now().UTC()
+		_, err = svc.ReplaceProviders(ctx, testPortalID, entity.FileKindAds, []*entity.Provider{provider})
+		require.NoError(t, err)
+
+		prs, err := svc.GetProvidersByPortal(ctx, testPortalName, "")
+		require.NoError(t, err)
+		require.Len(t, prs, 1)
+		assert.Equal(t, "pub-ABC", prs[0].AccountID)
+		assert.Equal(t, "F08C47FEC0942FA0", prs[0].CertAuthID)
+		assert.Equal(t, "google.com, pub-ABC, DIRECT, F08C47FEC0942FA0", prs[0].RawLine)
+
+		portals, err = svc.GetPortalsWithoutRawLines(ctx)
+		require.NoError(t, err)
+		assert.NotContains(t, portalNames(portals), testPortalName)
+	}
+}
+
+func testPortalVariables(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		testPortalName := "gizmodo.com"
+		testPortalID := 2
+		adsTxt := entity.ParseAdsTxt([]byte("OWNERDOMAIN=gizmodo.com\nMANAGERDOMAIN=manager.com, US\ncontact=ads@gizmodo.com\n"))
+		require.NoError(t, svc.ReplacePortalVariables(ctx, testPortalID, entity.FileKindAds, adsTxt.Variables))
+
+		vars, err := svc.GetPortalVariables(ctx, testPortalName)
+		require.NoError(t, err)
+		require.Len(t, vars, 3)
+		assert.Equal(t, entity.VarOwnerDomain, vars[0].Name)
+		assert.Equal(t, "manager.com, US", vars[1].Value)
+		assert.Equal(t, 3, vars[2].Line)
+
+		require.NoError(t, svc.ReplacePortalVariables(ctx, testPortalID, entity.FileKindAds, adsTxt.Variables[:1]))
+		vars, err = svc.GetPortalVariables(ctx, testPortalName)
+		require.NoError(t, err)
+		assert.Len(t, vars, 1)
+
+		// More variables than fit into the query parameters of a single insert, stored with the providers at once
+		many := make([]*entity.Variable, 12000)
+		for i := range many {
+			many[i] = &entity.Variable{Name: entity.VarContact, Value: fmt.Sprintf("ads%v@gizmodo.com", i), Line: i + 1}
+		}
+		provider := &entity.Provider{DomainName: "google.com", AccountID: "pub-1", AccountType: entity.RelationshipDirect, PortalID: testPortalID, CreatedAt: time.Now().UTC()}
+		bigCtx, bigCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer bigCancel()
+		n, err := svc.ReplaceProvidersAndVariables(bigCtx, testPortalID, entity.FileKindAppAds, []*entity.Provider{provider}, many)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		vars, err = svc.GetPortalVariables(bigCtx, testPortalName)
+		require.NoError(t, err)
+		assert.Len(t, vars, 1+len(many))
+
+		_, err = svc.ReplaceProvidersAndVariables(ctx, testPortalID, entity.FileKindAppAds, nil, nil)
+		require.NoError(t, err)
+		vars, err = svc.GetPortalVariables(ctx, testPortalName)
+		require.NoError(t, err)
+		assert.Len(t, vars, 1)
+
+		_, err = svc.GetPortalVariables(ctx, "unknown.com")
+		assert.Equal(t, entity.ErrNotFound, err)
+	}
+}
+
+func testSubdomainPortals(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		parent, err := svc.GetPortal(ctx, "nytimes.com")
+		require.NoError(t, err)
+		children, err := svc.AddSubdomainPortals(ctx, parent, []string{"cooking.nytimes.com", "games.nytimes.com"})
+		require.NoError(t, err)
+		require.Len(t, children, 2)
+		assert.Equal(t, parent.ID, children[0].ParentID)
+		assert.Equal(t, "nytimes.com", children[0].Parent)
+		assert.Equal(t, parent.Protocol, children[0].Protocol)
+
+		// Registering again returns the known children
+		children, err = svc.AddSubdomainPortals(ctx, parent, []string{"games.nytimes.com"})
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+
+		parent, err = svc.GetPortal(ctx, "nytimes.com")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"cooking.nytimes.com", "games.nytimes.com"}, parent.Subdomains)
+
+		job, err := svc.AddCrawlJob(ctx, []*entity.Portal{parent})
+		require.NoError(t, err)
+		require.NoError(t, svc.AddCrawlResults(ctx, job, children))
+		require.NoError(t, svc.UpdateCrawlJob(ctx, job))
+		stored, err := svc.GetCrawlJob(ctx, job.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 2, stored.PortalsTotal)
+		assert.Len(t, stored.Results, 2)
+	}
+}
+
+func testFileKinds(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		testPortalName := "wordpress.com"
+		testPortalID := 5
+		now := time.Now().UTC()
+		_, err := svc.ReplaceProviders(ctx, testPortalID, entity.FileKindAds, []*entity.Provider{
+			{DomainName: "google.com", AccountID: "pub-1", AccountType: "direct", PortalID: testPortalID, CreatedAt: now},
+		})
+		require.NoError(t, err)
+		// The same line may be listed in both files
+		n, err := svc.ReplaceProviders(ctx, testPortalID, entity.FileKindAppAds, []*entity.Provider{
+			{DomainName: "google.com", AccountID: "pub-1", AccountType: "direct", PortalID: testPortalID, CreatedAt: now},
+			{DomainName: "unity.com", AccountID: "123", AccountType: "reseller", PortalID: testPortalID, CreatedAt: now},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		prs, err := svc.GetProvidersByPortal(ctx, testPortalName, "")
+		require.NoError(t, err)
+		assert.Len(t, prs, 3)
+		prs, err = svc.GetProvidersByPortal(ctx, testPortalName, entity.FileKindAppAds)
+		require.NoError(t, err)
+		require.Len(t, prs, 2)
+		assert.Equal(t, entity.FileKindAppAds, prs[0].FileKind)
+		prs, err = svc.GetProvidersByPortal(ctx, testPortalName, entity.FileKindAds)
+		require.NoError(t, err)
+		assert.Len(t, prs, 1)
+
+		portal, err := svc.GetPortal(ctx, testPortalName)
+		require.NoError(t, err)
+		assert.Equal(t, entity.FileKindAds, portal.FileKind)
+		portal.FileKind = "app-ads"
+		require.NoError(t, svc.UpdatePortal(ctx, testPortalName, portal))
+		portal, err = svc.GetPortal(ctx, testPortalName)
+		require.NoError(t, err)
+		assert.Equal(t, entity.FileKindAppAds, portal.FileKind)
+	}
+}
+
+func testSellers(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		testPortalName := "bloomberg.com"
+		testPortalID := 4
+		adSystem := "sellers-test.com"
+		now := time.Now().UTC()
+		_, err := svc.ReplaceProviders(ctx, testPortalID, entity.FileKindAppAds, []*entity.Provider{
+			{DomainName: adSystem, AccountID: "1", AccountType: "direct", PortalID: testPortalID, CreatedAt: now},
+			{DomainName: adSystem, AccountID: "2", AccountType: "direct", PortalID: testPortalID, CreatedAt: now},
+			{DomainName: adSystem, AccountID: "3", AccountType: "reseller", PortalID: testPortalID, CreatedAt: now},
+		})
+		require.NoError(t, err)
+
+		domains, err := svc.GetProviderDomains(ctx)
+		require.NoError(t, err)
+		assert.Contains(t, domains, adSystem)
+
+		n, err := svc.ReplaceSellers(ctx, adSystem, []*entity.Seller{
+			{SellerID: "1", SellerType: entity.SellerPublisher},
+			{SellerID: "2", SellerType: entity.SellerIntermediary, Name: "Reseller Inc"},
+			{SellerID: "2", SellerType: entity.SellerIntermediary},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		prs, err := svc.GetProvidersByPortal(ctx, testPortalName, entity.FileKindAppAds)
+		require.NoError(t, err)
+		verification := map[string]string{}
+		for _, p := range prs {
+			verification[p.AccountID] = p.Verification
+		}
+		assert.Equal(t, map[string]string{
+			"1": entity.VerificationVerified,
+			"2": entity.VerificationTypeMismatch,
+			"3": entity.VerificationUnknown,
+		}, verification)
+
+		mismatches, err := svc.GetSellerMismatches(ctx, testPortalName)
+		require.NoError(t, err)
+		require.Len(t, mismatches, 1)
+		assert.Equal(t, "2", mismatches[0].Provider.AccountID)
+		assert.Equal(t, "Reseller Inc", mismatches[0].SellerName)
+
+		// Providers crawled later are verified against the stored sellers
+		_, err = svc.ReplaceProviders(ctx, testPortalID, entity.FileKindAppAds, []*entity.Provider{
+			{DomainName: adSystem, AccountID: "2", AccountType: "reseller", PortalID: testPortalID, CreatedAt: now},
+		})
+		require.NoError(t, err)
+		mismatches, err = svc.GetSellerMismatches(ctx, testPortalName)
+		require.NoError(t, err)
+		assert.Empty(t, mismatches)
+
+		_, err = svc.GetSellerMismatches(ctx, "unknown.com")
+		assert.Equal(t, entity.ErrNotFound, err)
+	}
+}
+
+func testPortalFiles(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		testPortalID := 1
+		_, err := svc.GetPortalFile(ctx, testPortalID, entity.FileKindAds)
+		assert.Equal(t, entity.ErrNotFound, err)
+
+		file := &entity.PortalFile{PortalID: testPortalID, FileKind: entity.FileKindAds, ETag: `"v1"`, SHA256: "abc", Providers: 3, FetchedAt: time.Now().UTC().Truncate(time.Second)}
+		require.NoError(t, svc.SavePortalFile(ctx, file))
+		stored, err := svc.GetPortalFile(ctx, testPortalID, entity.FileKindAds)
+		require.NoError(t, err)
+		assert.True(t, file.FetchedAt.Equal(stored.FetchedAt))
+		stored.FetchedAt = file.FetchedAt
+		assert.Equal(t, file, stored)
+
+		file.ETag = ""
+		file.LastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
+		require.NoError(t, svc.SavePortalFile(ctx, file))
+		stored, err = svc.GetPortalFile(ctx, testPortalID, entity.FileKindAds)
+		require.NoError(t, err)
+		assert.Equal(t, file.LastModified, stored.LastModified)
+		assert.Empty(t, stored.ETag)
+
+		_, err = svc.GetPortalFile(ctx, testPortalID, entity.FileKindAppAds)
+		assert.Equal(t, entity.ErrNotFound, err)
+
+		// Deleting the providers of a portal forgets the state of its files, so that they are parsed anew
+		deletedPortalID, deletedPortalName := 4, "bloomberg.com"
+		file = &entity.PortalFile{PortalID: deletedPortalID, FileKind: entity.FileKindAds, ETag: `"v1"`, SHA256: "abc", Providers: 3, FetchedAt: time.Now().UTC()}
+		require.NoError(t, svc.SavePortalFile(ctx, file))
+		require.NoError(t, svc.DeleteProvider(ctx, deletedPortalName))
+		_, err = svc.GetPortalFile(ctx, deletedPortalID, entity.FileKindAds)
+		assert.Equal(t, entity.ErrNotFound, err)
+	}
+}
+
+func testSnapshots(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		testPortalName := "gizmodo.com"
+		testPortalID := 2
+		old := time.Now().UTC().Add(-48 * time.Hour)
+		adsTxt := entity.ParseAdsTxt([]byte("google.com, pub-1, DIRECT\ninvalid line\n"))
+		first := &entity.Snapshot{PortalID: testPortalID, FileKind: entity.FileKindAds, FetchedAt: old, SHA256: "a", Providers: 1,
+			Content: "google.com, pub-1, DIRECT\ninvalid line\n", Diagnostics: adsTxt.Diagnostics}
+		added, err := svc.AddSnapshot(ctx, first)
+		require.NoError(t, err)
+		assert.True(t, added)
+
+		// The same body is not stored twice in a row
+		added, err = svc.AddSnapshot(ctx, &entity.Snapshot{PortalID: testPortalID, FileKind: entity.FileKindAds, FetchedAt: old.Add(time.Hour), SHA256: "a"})
+		require.NoError(t, err)
+		assert.False(t, added)
+		added, err = svc.AddSnapshot(ctx, &entity.Snapshot{PortalID: testPortalID, FileKind: entity.FileKindAds, FetchedAt: old.Add(2 * time.Hour), SHA256: "b", Content: "x"})
+		require.NoError(t, err)
+		assert.True(t, added)
+
+		snaps, err := svc.ListSnapshots(ctx, testPortalName)
+		require.NoError(t, err)
+		require.Len(t, snaps, 2)
+		assert.Equal(t, "b", snaps[0].SHA256)
+		assert.Empty(t, snaps[1].Content)
+
+		snap, err := svc.GetSnapshot(ctx, testPortalName, first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, first.Content, snap.Content)
+		assert.Equal(t, first.Diagnostics, snap.Diagnostics)
+		_, err = svc.GetSnapshot(ctx, "cnn.com", first.ID)
+		assert.Equal(t, entity.ErrNotFound, err)
+
+		// The latest snapshot of a file is kept past the retention period
+		n, err := svc.PruneSnapshots(ctx, time.Now().UTC())
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		snaps, err = svc.ListSnapshots(ctx, testPortalName)
+		require.NoError(t, err)
+		require.Len(t, snaps, 1)
+		assert.Equal(t, "b", snaps[0].SHA256)
+
+		_, err = svc.ListSnapshots(ctx, "unknown.com")
+		assert.Equal(t, entity.ErrNotFound, err)
+	}
+}
+
+func testProviderDiff(repo *repository.RDBMSRepository) func(t *testing.T) {
+	return func(t *testing.T) {
+		svc := New(config.Config{}, "", repo, &smsTestNotifier{}, &emailTestNotifier{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		testPortalName := "cnn.com"
+		testPortalID := 1
+		lastWeek := time.Now().UTC().Add(-7 * 24 * time.Hour)
+		_, err := svc.AddSnapshot(ctx, &entity.Snapshot{PortalID: testPortalID, FileKind: entity.FileKindAds, FetchedAt: lastWeek, SHA256: "a",
+			Content: "google.com, pub-1, DIRECT\nappnexus.com, 42, RESELLER\n"})
+		require.NoError(t, err)
+		latest := &entity.Snapshot{PortalID: testPortalID, FileKind: entity.FileKindAds, FetchedAt: time.Now().UTC().Add(-time.Hour), SHA256: "b",
+			Content: "appnexus.com, 42, DIRECT\nopenx.com, 7, RESELLER\n"}
+		_, err = svc.AddSnapshot(ctx, latest)
+		require.NoError(t, err)
+
+		from, err := entity.ParseSnapshotRef(lastWeek.Add(time.Minute).Format(time.RFC3339))
+		require.NoError(t, err)
+		diff, err := svc.DiffProviders(ctx, testPortalName, entity.FileKindAds, from, entity.SnapshotRef{ID: latest.ID})
+		require.NoError(t, err)
+		assert.Equal(t, "a", diff.From.SHA256)
+		assert.Empty(t, diff.To.Content)
+		require.Len(t, diff.Added, 1)
+		assert.Equal(t, "openx.com", diff.Added[0].DomainName)
+		require.Len(t, diff.Removed, 1)
+		assert.Equal(t, "google.com", diff.Removed[0].DomainName)
+		require.Len(t, diff.Changed, 1)
+		assert.Equal(t, entity.RelationshipDirect, diff.Changed[0].To.AccountType)
+
+		_, err = svc.DiffProviders(ctx, testPortalName, entity.FileKindAds, entity.SnapshotRef{At: lastWeek.Add(-time.Hour)}, entity.SnapshotRef{At: time.Now().UTC()})
+		assert.Equal(t, entity.ErrNotFound, errors.Cause(err))
+		_, err = svc.DiffProviders(ctx, "unknown.com", entity.FileKindAds, from, entity.SnapshotRef{At: time.Now().UTC()})
+		assert.Equal(t, entity.ErrNotFound, errors.Cause(err))
+
+		appAds := &entity.Snapshot{PortalID: testPortalID, FileKind: entity.FileKindAppAds, FetchedAt: time.Now().UTC().Add(-time.Hour), SHA256: "c",
+			Content: "google.com, pub-2, DIRECT\n"}
+		_, err = svc.AddSnapshot(ctx, appAds)
+		require.NoError(t, err)
+		_, err = svc.DiffProviders(ctx, testPortalName, entity.FileKindAds, from, entity.SnapshotRef{ID: appAds.ID})
+		assert.Equal(t, entity.ErrSnapshotMismatch, errors.Cause(err))
+		_, err = svc.DiffProviders(ctx, testPortalName, entity.FileKindAds, entity.SnapshotRef{ID: appAds.ID}, entity.SnapshotRef{})
+		assert.Equal(t, entity.ErrSnapshotMismatch, errors.Cause(err))
+		_, err = svc.DiffProviders(ctx, testPortalName, "", entity.SnapshotRef{ID: latest.ID}, entity.SnapshotRef{ID: appAds.ID})
+		assert.Equal(t, entity.ErrSnapshotMismatch, errors.Cause(err))
+		diff, err = svc.DiffProviders(ctx, testPortalName, "", entity.SnapshotRef{ID: appAds.ID}, entity.SnapshotRef{})
+		require.NoError(t, err)
+		assert.Equal(t, "c", diff.To.SHA256)
+
+		other := &entity.Snapshot{PortalID: 2, FileKind: entity.FileKindAds, FetchedAt: time.Now().UTC().Add(-time.Hour), SHA256: "d",
+			Content: "openx.com, 7, RESELLER\n"}
+		_, err = svc.AddSnapshot(ctx, other)
+		require.NoError(t, err)
+		_, err = svc.DiffProviders(ctx, testPortalName, entity.FileKindAds, from, entity.SnapshotRef{ID: other.ID})
+		assert.Error(t, err)
+	}
+}
+
+func portalNames(portals []*entity.Portal) []string {
+	var names []string
+	for _, p := range portals {
+		names = append(names, p.CanonicalName)
+	}
+	return names
+}
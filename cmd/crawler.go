@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/urfave/cli"
 
 	"github.com/nettyrnp/ads-crawler/api"
 	"github.com/nettyrnp/ads-crawler/api/common"
+	"github.com/nettyrnp/ads-crawler/api/sys"
+	"github.com/nettyrnp/ads-crawler/api/sys/crawler"
+	"github.com/nettyrnp/ads-crawler/api/sys/entity"
+	"github.com/nettyrnp/ads-crawler/api/sys/importer"
 	"github.com/nettyrnp/ads-crawler/api/sys/repository"
+	"github.com/nettyrnp/ads-crawler/api/sys/service"
 	"github.com/nettyrnp/ads-crawler/config"
 )
 
@@ -78,6 +87,279 @@ func migrateCmd(flags []cli.Flag) cli.Command {
 	}
 }
 
+func crawlCmd(flags []cli.Flag) cli.Command {
+	return cli.Command{
+		Name:  "crawl",
+		Usage: "Crawls the ads.txt files of all portals (or of the given ones) once and exits",
+		Flags: append(flags, cli.StringSliceFlag{
+			Name:  "portal, p",
+			Usage: "Canonical name of the portal to crawl, can be repeated",
+		}),
+		Action: func(c *cli.Context) error {
+			env := c.String("env")
+			if env == "" {
+				return errors.New("you must specify an environment file")
+			}
+
+			conf := config.Load(env)
+			common.InitLogger(conf)
+			svc := sys.NewService(conf, string(entity.KindCrawler))
+			cr := sys.NewCrawler(conf, svc)
+
+			ctx, cancel := interruptibleContext()
+			defer cancel()
+
+			portals, err := svc.GetPortals(ctx)
+			if err != nil {
+				return err
+			}
+			if names := c.StringSlice("portal"); len(names) > 0 {
+				portals, err = filterPortals(portals, names)
+				if err != nil {
+					return err
+				}
+			}
+
+			return runCrawlJob(ctx, svc, cr, portals)
+		},
+	}
+}
+
+func backfillCmd(flags []cli.Flag) cli.Command {
+	return cli.Command{
+		Name:  "backfill",
+		Usage: "Re-crawls the portals whose providers were stored with lowercased account IDs, repairing them",
+		Flags: flags,
+		Action: func(c *cli.Context) error {
+			env := c.String("env")
+			if env == "" {
+				return errors.New("you must specify an environment file")
+			}
+
+			conf := config.Load(env)
+			common.InitLogger(conf)
+			svc := sys.NewService(conf, string(entity.KindCrawler))
+			cr := sys.NewCrawler(conf, svc)
+			cr.Force = true
+
+			ctx, cancel := interruptibleContext()
+			defer cancel()
+
+			portals, err := svc.GetPortalsWithoutRawLines(ctx)
+			if err != nil {
+				return err
+			}
+			if len(portals) == 0 {
+				fmt.Println("nothing to backfill")
+				return nil
+			}
+			// Portals which cannot be crawled now keep their old providers and are picked up by the next run
+			return runCrawlJob(ctx, svc, cr, portals)
+		},
+	}
+}
+
+func sellersCmd(flags []cli.Flag) cli.Command {
+	return cli.Command{
+		Name:  "sellers",
+		Usage: "Crawls the sellers.json of every advertising system and verifies the providers against it",
+		Flags: flags,
+		Action: func(c *cli.Context) error {
+			env := c.String("env")
+			if env == "" {
+				return errors.New("you must specify an environment file")
+			}
+
+			conf := config.Load(env)
+			common.InitLogger(conf)
+			svc := sys.NewService(conf, string(entity.KindCrawler))
+			cr := sys.NewCrawler(conf, svc)
+
+			ctx, cancel := interruptibleContext()
+			defer cancel()
+
+			results, err := cr.CrawlSellers(ctx)
+			failed := 0
+			for _, res := range results {
+				if res.Error != "" {
+					failed++
+				}
+				fmt.Printf("%-30s sellers=%v notFound=%v %s\n", res.AdSystem, res.Sellers, res.NotFound, res.Error)
+			}
+			fmt.Printf("crawled sellers.json of %v advertising systems, %v failed\n", len(results), failed)
+			return err
+		},
+	}
+}
+
+// interruptibleContext is cancelled on SIGINT or SIGTERM
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupted:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// runCrawlJob crawls the portals as a recorded job and prints the results
+func runCrawlJob(ctx context.Context, svc *service.AdsService, cr *crawler.Crawler, portals []*entity.Portal) error {
+	job, err := svc.AddCrawlJob(ctx, portals)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("crawl job %v: crawling %v portals\n", job.ID, len(portals))
+	cr.RunJob(ctx, job, portals)
+
+	for _, res := range job.Results {
+		fmt.Printf("%-30s %-9s providers=%v errors=%v %s\n", res.PortalName, res.Outcome, res.Providers, res.Errors, res.Message)
+	}
+	fmt.Printf("crawl job %v %s: %v providers, %v errors, %v portals unchanged, %v portals failed\n", job.ID, job.State, job.Providers, job.Errors, job.Unchanged, job.Failed)
+	if job.State != entity.JobDone {
+		return fmt.Errorf("crawl job %v %s: %s", job.ID, job.State, job.Message)
+	}
+	return nil
+}
+
+func importCmd(flags []cli.Flag) cli.Command {
+	return cli.Command{
+		Name:  "import",
+		Usage: "Imports portals from a CSV or JSON lines file (columns: domain, protocol, email, phone, file_kind)",
+		Flags: append(flags,
+			cli.StringFlag{
+				Name:  "file, f",
+				Usage: "Path to the portal list",
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Usage: "Format of the portal list: csv or jsonl (guessed from the file extension by default)",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			env := c.String("env")
+			if env == "" {
+				return errors.New("you must specify an environment file")
+			}
+			fileName := c.String("file")
+			if fileName == "" {
+				return errors.New("you must specify a portal list file")
+			}
+			var format importer.Format
+			var err error
+			if c.String("format") != "" {
+				format, err = importer.ParseFormat(c.String("format"))
+			} else {
+				format, err = importer.FormatOf(fileName)
+			}
+			if err != nil {
+				return err
+			}
+
+			conf := config.Load(env)
+			common.InitLogger(conf)
+			svc := sys.NewService(conf, string(entity.KindCrawler))
+
+			file, err := os.Open(fileName)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			report, importErr := svc.ImportPortals(context.Background(), file, format)
+			if report != nil {
+				out, _ := json.MarshalIndent(report, "", "  ")
+				fmt.Println(string(out))
+			}
+			return importErr
+		},
+	}
+}
+
+func diffCmd(flags []cli.Flag) cli.Command {
+	return cli.Command{
+		Name:  "diff",
+		Usage: "Prints the providers added, removed and changed on a portal between two crawl points as JSON",
+		Flags: append(flags,
+			cli.StringFlag{
+				Name:  "portal, p",
+				Usage: "Canonical name of the portal",
+			},
+			cli.StringFlag{
+				Name:  "from",
+				Usage: "Snapshot ID, RFC 3339 time or date to compare from",
+			},
+			cli.StringFlag{
+				Name:  "to",
+				Usage: "Snapshot ID, RFC 3339 time or date to compare to (the latest snapshot by default)",
+			},
+			cli.StringFlag{
+				Name:  "file-kind",
+				Usage: "File to compare: ads.txt (default) or app-ads.txt",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			env := c.String("env")
+			if env == "" {
+				return errors.New("you must specify an environment file")
+			}
+			portalName := c.String("portal")
+			if portalName == "" {
+				return errors.New("you must specify a portal")
+			}
+			if c.String("from") == "" {
+				return errors.New("you must specify a crawl point to compare from")
+			}
+			from, err := entity.ParseSnapshotRef(c.String("from"))
+			if err != nil {
+				return err
+			}
+			to, err := entity.ParseSnapshotRef(c.String("to"))
+			if err != nil {
+				return err
+			}
+			var kind entity.FileKind
+			if c.String("file-kind") != "" {
+				if kind, err = entity.ParseFileKind(c.String("file-kind")); err != nil || kind == entity.FileKindBoth {
+					return fmt.Errorf("invalid file kind '%s', expected '%s' or '%s'", c.String("file-kind"), entity.FileKindAds, entity.FileKindAppAds)
+				}
+			}
+
+			conf := config.Load(env)
+			common.InitLogger(conf)
+			svc := sys.NewService(conf, string(entity.KindCrawler))
+
+			diff, err := svc.DiffProviders(context.Background(), portalName, kind, from, to)
+			if err != nil {
+				return err
+			}
+			out, _ := json.MarshalIndent(diff, "", "  ")
+			fmt.Println(string(out))
+			return nil
+		},
+	}
+}
+
+func filterPortals(portals []*entity.Portal, names []string) ([]*entity.Portal, error) {
+	byName := map[string]*entity.Portal{}
+	for _, p := range portals {
+		byName[p.CanonicalName] = p
+	}
+	var filtered []*entity.Portal
+	for _, name := range names {
+		p, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown portal: %s", name)
+		}
+		filtered = append(filtered, p)
+	}
+	return filtered, nil
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "Ads Crawler"
@@ -94,6 +376,11 @@ func main() {
 	app.Commands = []cli.Command{
 		startCmd(startFlags),
 		migrateCmd(startFlags),
+		crawlCmd(startFlags),
+		importCmd(startFlags),
+		backfillCmd(startFlags),
+		sellersCmd(startFlags),
+		diffCmd(startFlags),
 	}
 	err := app.Run(os.Args)
 	if err != nil {
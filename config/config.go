@@ -7,6 +7,7 @@ import (
 	"path"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/caarlos0/env"
 	"github.com/joho/godotenv"
@@ -40,6 +41,32 @@ type Config struct {
 	LogMaxAge   int    `env:"LOG_MAX_AGE"`
 	LogCompress bool   `env:"LOG_COMPRESS"`
 
+	CrawlConcurrency       int           `env:"CRAWL_CONCURRENCY" envDefault:"8"`
+	CrawlHostConcurrency   int           `env:"CRAWL_HOST_CONCURRENCY" envDefault:"1"`
+	CrawlHostDelay         time.Duration `env:"CRAWL_HOST_DELAY" envDefault:"1s"`
+	CrawlProtocolSwitch    int           `env:"CRAWL_PROTOCOL_SWITCH" envDefault:"3"`     // consecutive crawls over the other protocol before switching a portal to it
+	CrawlMaxBodySize       int64         `env:"CRAWL_MAX_BODY_SIZE" envDefault:"5242880"` // bytes of an ads.txt read at most, 0 disables the limit
+	CrawlConnectTimeout    time.Duration `env:"CRAWL_CONNECT_TIMEOUT" envDefault:"10s"`
+	CrawlReadTimeout       time.Duration `env:"CRAWL_READ_TIMEOUT" envDefault:"30s"`      // till the response is read completely
+	CrawlRejectNonText     bool          `env:"CRAWL_REJECT_NON_TEXT" envDefault:"false"` // otherwise files not served as text/plain are only warned about
+	CrawlUserAgent         string        `env:"CRAWL_USER_AGENT" envDefault:"ads-crawler/1.0 (+https://github.com/nettyrnp/ads-crawler)"`
+	CrawlHeaders           []string      `env:"CRAWL_HEADERS" envSeparator:"|"`              // extra request headers, as 'Name: value'
+	CrawlProxy             string        `env:"CRAWL_PROXY"`                                 // http://, https:// or socks5:// URL, HTTP_PROXY and HTTPS_PROXY apply otherwise
+	CrawlCABundle          string        `env:"CRAWL_CA_BUNDLE"`                             // PEM file of CA certificates trusted besides the ones of the system
+	CrawlSoftNotFoundRatio float64       `env:"CRAWL_SOFT_NOT_FOUND_RATIO" envDefault:"0.8"` // of invalid data records taking a file as missing, 0 disables it
+	CrawlJobHeartbeat      time.Duration `env:"CRAWL_JOB_HEARTBEAT" envDefault:"1m"`         // how often a running job records that it is alive
+	CrawlJobStaleAfter     time.Duration `env:"CRAWL_JOB_STALE_AFTER" envDefault:"10m"`      // without a heartbeat, after which an unfinished job is taken as interrupted, 0 takes all of them at startup
+
+	SellersMaxBodySize int64         `env:"SELLERS_MAX_BODY_SIZE" envDefault:"209715200"` // bytes of a sellers.json read at most, 0 disables the limit
+	SellersReadTimeout time.Duration `env:"SELLERS_READ_TIMEOUT" envDefault:"5m"`         // till the response of a sellers.json is read completely
+
+	SchedulerEnabled  bool          `env:"SCHEDULER_ENABLED" envDefault:"true"`
+	SchedulerInterval time.Duration `env:"SCHEDULER_INTERVAL" envDefault:"24h"`
+	SchedulerJitter   time.Duration `env:"SCHEDULER_JITTER" envDefault:"1h"`
+	SchedulerTick     time.Duration `env:"SCHEDULER_TICK" envDefault:"1m"`
+
+	SnapshotRetention time.Duration `env:"SNAPSHOT_RETENTION" envDefault:"2160h"` // 0 keeps the snapshots forever
+
 	RepositoryDriver string `env:"CUSTOMER_REPOSITORY_DRIVER"`
 	RepositoryDSN    string `env:"CUSTOMER_REPOSITORY_DSN"`
 